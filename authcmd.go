@@ -0,0 +1,135 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"fortnox_dynamics_integration/pkg/fortnox"
+)
+
+// runAuth hanterar kommandot "auth":
+//
+//	auth [--headless]        auktorisera mot Fortnox interaktivt
+//	auth url                 skriv ut auktoriserings-URL:en, state och ev. PKCE-verifierare
+//	auth exchange --code X   byt en kod från redirect-URL:en mot tokens
+func runAuth(args []string) {
+	if len(args) > 0 {
+		switch args[0] {
+		case "url":
+			runAuthURL(args[1:])
+			return
+		case "exchange":
+			runAuthExchange(args[1:])
+			return
+		}
+	}
+
+	fs := flag.NewFlagSet("auth", flag.ExitOnError)
+	headless := fs.Bool("headless", false, "print the authorization URL and read the redirect URL from stdin instead of opening a browser")
+	fs.Parse(args)
+
+	fortnoxClient, err := fortnox.NewFortnoxClient()
+	if err != nil {
+		log.Fatalf("Failed to create Fortnox client: %v", err)
+	}
+
+	if err := authorize(fortnoxClient, *headless); err != nil {
+		log.Fatalf("Failed to authorize: %v", err)
+	}
+}
+
+func runAuthURL(args []string) {
+	fs := flag.NewFlagSet("auth url", flag.ExitOnError)
+	fs.Parse(args)
+
+	fortnoxClient, err := fortnox.NewFortnoxClient()
+	if err != nil {
+		log.Fatalf("Failed to create Fortnox client: %v", err)
+	}
+
+	flow, err := fortnoxClient.NewAuthFlow()
+	if err != nil {
+		log.Fatalf("Failed to start authorization: %v", err)
+	}
+
+	// State och verifierare behövs när koden senare byts med "auth exchange"
+	fmt.Println(fortnoxClient.AuthorizationURL(flow))
+	fmt.Fprintf(os.Stderr, "state: %s\n", flow.State)
+	if flow.CodeVerifier != "" {
+		fmt.Fprintf(os.Stderr, "verifier: %s\n", flow.CodeVerifier)
+	}
+}
+
+func runAuthExchange(args []string) {
+	fs := flag.NewFlagSet("auth exchange", flag.ExitOnError)
+	code := fs.String("code", "", "authorization code, or the full redirect URL containing it")
+	state := fs.String("state", "", "state printed by \"auth url\", checked against the redirect URL if given")
+	verifier := fs.String("verifier", "", "PKCE code verifier printed by \"auth url\"")
+	fs.Parse(args)
+
+	if *code == "" {
+		log.Fatal("--code is required")
+	}
+
+	fortnoxClient, err := fortnox.NewFortnoxClient()
+	if err != nil {
+		log.Fatalf("Failed to create Fortnox client: %v", err)
+	}
+
+	parsedCode, err := fortnox.ParseAuthorizationResponse(*code, *state)
+	if err != nil {
+		log.Fatalf("Invalid authorization code: %v", err)
+	}
+	if err := fortnoxClient.ExchangeAuthorizationCodeWithVerifier(parsedCode, *verifier); err != nil {
+		log.Fatalf("Failed to exchange authorization code: %v", err)
+	}
+
+	log.Println("Authorization successful")
+}
+
+// authorize kör auktoriseringsflödet. Utan skrivbordsmiljö, eller om FORTNOX_HEADLESS=true,
+// används det huvudlösa flödet som läser redirect-URL:en från stdin.
+func authorize(fortnoxClient *fortnox.FortnoxClient, headless bool) error {
+	if useHeadless(headless) {
+		return fortnoxClient.StartHeadlessAuthorizationFlow(os.Stdin, os.Stderr)
+	}
+	return fortnoxClient.StartAuthorizationFlow()
+}
+
+// useHeadless avgör om auktoriseringen sker utan webbläsare
+func useHeadless(headless bool) bool {
+	return headless || os.Getenv("FORTNOX_HEADLESS") == "true" || !fortnox.HasDesktop()
+}
+
+// stdinIsTerminal avgör om någon kan klistra in koden i det huvudlösa flödet, vilket
+// inte går när programmet körs från cron eller en tjänst
+func stdinIsTerminal() bool {
+	info, err := os.Stdin.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// ensureAuthorized startar auktoriseringsflödet om vi inte har en giltig token
+// och inte heller kan förnya den med en sparad refresh token
+func ensureAuthorized(fortnoxClient *fortnox.FortnoxClient, headless bool) error {
+	if fortnoxClient.AccessToken != "" && time.Now().Before(fortnoxClient.ExpiresAt) {
+		return nil
+	}
+	if fortnoxClient.RefreshToken != "" {
+		err := fortnoxClient.RefreshAccessToken()
+		if err == nil {
+			return nil
+		}
+		log.Printf("Could not refresh the Fortnox access token: %v", err)
+
+		// Utan terminal kan det huvudlösa flödet inte fråga efter koden, och skulle bara vänta
+		if useHeadless(headless) && !stdinIsTerminal() {
+			return fmt.Errorf("failed to refresh access token and cannot prompt for authorization without a terminal: %w", err)
+		}
+	}
+
+	log.Println("Starting authorization flow")
+	return authorize(fortnoxClient, headless)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"fortnox_dynamics_integration/pkg/dynamics"
+	"fortnox_dynamics_integration/pkg/fortnox"
+)
+
+// errorAction är vad synkroniseringen gör med en faktura som misslyckades
+type errorAction int
+
+const (
+	actionDeadLetter errorAction = iota // Bestående fel som kräver åtgärd, t.ex. valideringsfel eller saknad kund
+	actionRetry                         // Tillfälligt fel, t.ex. rate limit, 5xx eller nätverksfel
+	actionSkip                          // Fakturan finns inte längre i Fortnox och ska inte synkas
+)
+
+func (a errorAction) String() string {
+	switch a {
+	case actionRetry:
+		return "retry"
+	case actionSkip:
+		return "skip"
+	default:
+		return "dead-letter"
+	}
+}
+
+// classifyError avgör utifrån de typade API-felen vad som ska hända med en misslyckad faktura
+func classifyError(err error) errorAction {
+	var fortnoxErr *fortnox.APIError
+	if errors.As(err, &fortnoxErr) {
+		switch {
+		case fortnoxErr.Temporary():
+			return actionRetry
+		case fortnoxErr.NotFound():
+			return actionSkip
+		default:
+			return actionDeadLetter
+		}
+	}
+
+	var odataErr *dynamics.ODataError
+	if errors.As(err, &odataErr) {
+		if odataErr.Temporary() {
+			return actionRetry
+		}
+		return actionDeadLetter
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return actionRetry
+	}
+
+	return actionDeadLetter
+}
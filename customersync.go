@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"fortnox_dynamics_integration/pkg/dynamics"
+	"fortnox_dynamics_integration/pkg/fortnox"
+	"fortnox_dynamics_integration/pkg/mapping"
+)
+
+// runCustomers hanterar kommandot "customers", som synkroniserar kunder från Fortnox till
+// konton i Dynamics 365. Konton som saknas skapas och ändrade konton uppdateras enligt
+// avsnittet accounts i fältmappningen.
+func runCustomers(args []string) {
+	fs := flag.NewFlagSet("customers", flag.ExitOnError)
+	since := fs.String("since", "", "only sync customers modified since this time (YYYY-MM-DD or YYYY-MM-DD HH:MM)")
+	dryRun := fs.Bool("dry-run", false, "print planned Dynamics 365 writes as JSON lines on stdout instead of performing them")
+	headless := fs.Bool("headless", false, "authorize Fortnox without a browser if authorization is needed")
+	fs.Parse(args)
+
+	invoiceMapping, err := loadMapping()
+	if err != nil {
+		log.Fatalf("Failed to load field mapping: %v", err)
+	}
+	if invoiceMapping.Accounts == nil {
+		log.Fatal("The field mapping has no accounts section, customers cannot be synced")
+	}
+	warnUnmappedAccountFields(invoiceMapping.Accounts)
+
+	filters := make(map[string]string)
+	if *since != "" {
+		t, err := parseSince(*since)
+		if err != nil {
+			log.Fatalf("Invalid filter flags: %v", err)
+		}
+		filters["lastmodified"] = t.Format(fortnoxTimeLayout)
+	}
+
+	fortnoxClient, err := fortnox.NewFortnoxClient()
+	if err != nil {
+		log.Fatalf("Failed to create Fortnox client: %v", err)
+	}
+	if err := ensureAuthorized(fortnoxClient, *headless); err != nil {
+		log.Fatalf("Failed to start authorization flow: %v", err)
+	}
+
+	stopping, aborting, release := shutdownContexts()
+	defer release()
+
+	startTime := time.Now()
+	customers, err := fortnoxClient.FetchCustomersContext(stopping, filters)
+	if err != nil {
+		log.Fatalf("Failed to fetch customers: %v", err)
+	}
+	log.Printf("Fetched %d customers in %s", len(customers), time.Since(startTime))
+
+	// Kundsynkroniseringen använder inte lagret med synkroniserade fakturor
+	s, err := newSyncer(stopping, fortnoxClient, nil, invoiceMapping, *dryRun)
+	if err != nil {
+		log.Fatalf("Failed to set up Dynamics client: %v", err)
+	}
+
+	failed := s.syncCustomers(stopping, aborting, customers)
+	log.Printf("Synced %d customers in %s, %d failed", len(customers), time.Since(startTime), failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// warnUnmappedAccountFields varnar för kundfält som kontona inte får, till exempel
+// organisationsnumret som standardmappningen saknar en kolumn för
+func warnUnmappedAccountFields(accounts *mapping.Table) {
+	for _, field := range mapping.DefaultUnmappedAccountFields {
+		if !accounts.MapsField(field) {
+			log.Printf("Warning: the accounts section of the field mapping has no column for %s, so it is not written to Dynamics 365. Map it to a column in SYNC_MAPPING_FILE.", field)
+		}
+	}
+}
+
+// syncCustomers synkroniserar kunderna med numWorkers parallella workers och returnerar
+// antalet kunder som misslyckades. Inga nya kunder påbörjas när stopping avbryts.
+func (s *syncer) syncCustomers(stopping, ctx context.Context, customers []fortnox.Customer) int64 {
+	customerChan := make(chan fortnox.Customer, len(customers))
+	for _, customer := range customers {
+		customerChan <- customer
+	}
+	close(customerChan)
+
+	var failed atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < numWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for customer := range customerChan {
+				if stopping.Err() != nil {
+					return
+				}
+				if err := s.syncListedCustomer(ctx, customer); err != nil {
+					log.Printf("Failed to sync customer %s: %v", customer.CustomerNumber, err)
+					failed.Add(1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	return failed.Load()
+}
+
+// syncListedCustomer hämtar hela kunden från Fortnox och synkroniserar den. Listan över kunder
+// saknar bland annat land, och en mappad kolumn som saknas i listan skulle annars tömmas i
+// kontot vid varje körning. En kund som tagits bort sedan listan hämtades hoppas över.
+func (s *syncer) syncListedCustomer(ctx context.Context, listed fortnox.Customer) error {
+	customer, err := s.fortnox.FetchCustomerContext(ctx, listed.CustomerNumber)
+	var fortnoxErr *fortnox.APIError
+	if errors.As(err, &fortnoxErr) && fortnoxErr.NotFound() {
+		log.Printf("Customer %s no longer exists in Fortnox, skipping", listed.CustomerNumber)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to fetch customer %s from Fortnox: %w", listed.CustomerNumber, err)
+	}
+
+	_, err = s.syncCustomer(ctx, *customer)
+	return err
+}
+
+// syncCustomer skapar eller uppdaterar kontot för en Fortnox-kund och returnerar kontots ID
+func (s *syncer) syncCustomer(ctx context.Context, customer fortnox.Customer) (string, error) {
+	accounts := s.mapping.Accounts
+	record, err := accounts.Apply(customer)
+	if err != nil {
+		return "", fmt.Errorf("failed to map customer %s: %w", customer.CustomerNumber, err)
+	}
+
+	accountID, err := s.dynamics.FindRecordIDContext(ctx, accounts.EntitySet, accounts.IDColumn, dynamics.Eq(accounts.KeyColumn, accounts.Key(record)))
+	if err != nil {
+		return "", fmt.Errorf("failed to search account for customer number %s: %w", customer.CustomerNumber, err)
+	}
+
+	if accountID == "" {
+		accountID, err = s.writer.CreateRecordContext(ctx, accounts.EntitySet, dynamics.Record(record))
+		if err != nil {
+			return "", fmt.Errorf("failed to create account for customer number %s: %w", customer.CustomerNumber, err)
+		}
+		log.Printf("Created account for customer %s", customer.CustomerNumber)
+		return accountID, nil
+	}
+
+	existing, err := s.dynamics.GetRecordContext(ctx, accounts.EntitySet, accountID, accounts.UpdateColumns()...)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch account ID %s for customer number %s: %w", accountID, customer.CustomerNumber, err)
+	}
+
+	changes := accounts.Diff(existing, record)
+	if len(changes) == 0 {
+		log.Printf("Account for customer %s already up to date", customer.CustomerNumber)
+		return accountID, nil
+	}
+	if err := s.writer.UpdateRecordContext(ctx, accounts.EntitySet, accountID, changes); err != nil {
+		return "", fmt.Errorf("failed to update account ID %s for customer number %s: %w", accountID, customer.CustomerNumber, err)
+	}
+	log.Printf("Updated account for customer %s (%d changed fields)", customer.CustomerNumber, len(changes))
+	return accountID, nil
+}
+
+// createMissingCustomer hämtar fakturans kund från Fortnox och skapar kontot i Dynamics 365.
+// Kunderna skapas en i taget, så att två fakturor för samma nya kund inte ger två konton.
+// Finns kunden inte heller i Fortnox returneras ett tomt ID.
+func (s *syncer) createMissingCustomer(ctx context.Context, invoice fortnox.Invoice) (string, error) {
+	s.customerMu.Lock()
+	defer s.customerMu.Unlock()
+
+	if accountID, ok := s.customerIDs[invoice.CustomerNumber]; ok {
+		return accountID, nil
+	}
+
+	customer, err := s.fortnox.FetchCustomerContext(ctx, invoice.CustomerNumber)
+	var fortnoxErr *fortnox.APIError
+	if errors.As(err, &fortnoxErr) && fortnoxErr.NotFound() {
+		// Ett 404 från Fortnox skulle annars hoppa över fakturan som borttagen
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch customer %s from Fortnox for document number %s: %w", invoice.CustomerNumber, invoice.DocumentNumber, err)
+	}
+
+	accountID, err := s.syncCustomer(ctx, *customer)
+	if err != nil {
+		return "", err
+	}
+
+	if s.customerIDs == nil {
+		s.customerIDs = make(map[string]string)
+	}
+	s.customerIDs[invoice.CustomerNumber] = accountID
+	return accountID, nil
+}
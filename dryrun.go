@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"fortnox_dynamics_integration/pkg/dynamics"
+	"fortnox_dynamics_integration/pkg/mapping"
+)
+
+// dryRunIDPrefix markerar påhittade ID:n för fakturor, rader och konton som skulle ha skapats
+const dryRunIDPrefix = "dry-run:"
+
+// plannedWrite är en rad i planen som skrivs ut vid --dry-run
+type plannedWrite struct {
+	Action         string      `json:"action"`
+	Endpoint       string      `json:"endpoint"`
+	DocumentNumber string      `json:"document_number,omitempty"`
+	CustomerNumber string      `json:"customer_number,omitempty"`
+	InvoiceID      string      `json:"invoice_id,omitempty"`
+	Reason         string      `json:"reason"`
+	Body           interface{} `json:"body,omitempty"`
+}
+
+// planRecorder ersätter de skrivande anropen mot Dynamics 365 vid --dry-run.
+// Varje anrop skrivs som en JSON-rad istället för att utföras.
+type planRecorder struct {
+	mu      sync.Mutex
+	enc     *json.Encoder
+	mapping *mapping.Mapping // Anger vilka kolumner som håller dokument- och kundnummer
+}
+
+func newPlanRecorder(w io.Writer, m *mapping.Mapping) *planRecorder {
+	return &planRecorder{enc: json.NewEncoder(w), mapping: m}
+}
+
+func (p *planRecorder) record(write plannedWrite) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.enc.Encode(write)
+}
+
+// documentNumber returnerar fakturans dokumentnummer i en post som skulle ha skrivits
+func (p *planRecorder) documentNumber(record interface{}) string {
+	return keyValue(record, p.mapping.KeyColumn)
+}
+
+// isAccount avgör om entitetsmängden är kontotabellen som kundsynkroniseringen skriver till
+func (p *planRecorder) isAccount(entitySet string) bool {
+	return p.mapping.Accounts != nil && entitySet == p.mapping.Accounts.EntitySet
+}
+
+// isInvoice avgör om entitetsmängden är fakturatabellen
+func (p *planRecorder) isInvoice(entitySet string) bool {
+	return entitySet == p.mapping.EntitySet
+}
+
+// isRow avgör om entitetsmängden är tabellen som fakturaraderna skrivs till
+func (p *planRecorder) isRow(entitySet string) bool {
+	return p.mapping.Rows != nil && entitySet == p.mapping.Rows.EntitySet
+}
+
+// keyValue returnerar nyckelkolumnens värde i en post som skulle ha skrivits
+func keyValue(record interface{}, keyColumn string) string {
+	if r, ok := record.(dynamics.Record); ok && r[keyColumn] != nil {
+		return fmt.Sprint(r[keyColumn])
+	}
+	return ""
+}
+
+func (p *planRecorder) CreateRecordContext(ctx context.Context, entitySet string, record interface{}) (string, error) {
+	if p.isAccount(entitySet) {
+		customerNumber := keyValue(record, p.mapping.Accounts.KeyColumn)
+		err := p.record(plannedWrite{
+			Action:         "create",
+			Endpoint:       entitySet,
+			CustomerNumber: customerNumber,
+			Reason:         "customer account does not exist in Dynamics 365",
+			Body:           record,
+		})
+		return dryRunIDPrefix + customerNumber, err
+	}
+
+	if p.isRow(entitySet) {
+		row := keyValue(record, p.mapping.Rows.KeyColumn)
+		err := p.record(plannedWrite{
+			Action:   "create",
+			Endpoint: entitySet,
+			Reason:   fmt.Sprintf("invoice row %s does not exist in Dynamics 365", row),
+			Body:     record,
+		})
+		return dryRunIDPrefix + row, err
+	}
+
+	documentNumber := p.documentNumber(record)
+	err := p.record(plannedWrite{
+		Action:         "create",
+		Endpoint:       entitySet,
+		DocumentNumber: documentNumber,
+		Reason:         "invoice does not exist in Dynamics 365",
+		Body:           record,
+	})
+	return dryRunIDPrefix + documentNumber, err
+}
+
+func (p *planRecorder) UpsertContext(ctx context.Context, entitySet string, alternateKey map[string]interface{}, body interface{}, condition dynamics.UpsertCondition) (dynamics.UpsertResult, error) {
+	documentNumber := p.documentNumber(body)
+	err := p.record(plannedWrite{
+		Action:         "upsert",
+		Endpoint:       dynamics.AlternateKeyEndpoint(entitySet, alternateKey),
+		DocumentNumber: documentNumber,
+		Reason:         "create or update invoice by document number",
+		Body:           body,
+	})
+	return dynamics.UpsertResult{ID: dryRunIDPrefix + documentNumber}, err
+}
+
+func (p *planRecorder) UpdateRecordContext(ctx context.Context, entitySet, id string, changes map[string]interface{}) error {
+	write := plannedWrite{
+		Action:   "update",
+		Endpoint: fmt.Sprintf("%s(%s)", entitySet, id),
+		Reason:   changedFields(changes),
+		Body:     changes,
+	}
+	if p.isInvoice(entitySet) {
+		write.InvoiceID = id
+	}
+	return p.record(write)
+}
+
+func (p *planRecorder) UploadFileToContext(ctx context.Context, entitySet, entityID, field, filename string, fileData []byte) error {
+	reason := "invoice content changed"
+	if documentNumber, ok := strings.CutPrefix(entityID, dryRunIDPrefix); ok {
+		reason = fmt.Sprintf("PDF for new invoice %s", documentNumber)
+	}
+
+	return p.record(plannedWrite{
+		Action:    "upload",
+		Endpoint:  fmt.Sprintf("%s(%s)/%s", entitySet, entityID, field),
+		InvoiceID: entityID,
+		Reason:    fmt.Sprintf("%s (%s, %d bytes)", reason, filename, len(fileData)),
+	})
+}
+
+func (p *planRecorder) DeleteRecordContext(ctx context.Context, entitySet, id string) error {
+	if p.isRow(entitySet) {
+		return p.record(plannedWrite{
+			Action:   "delete",
+			Endpoint: fmt.Sprintf("%s(%s)", entitySet, id),
+			Reason:   "invoice row no longer exists in Fortnox",
+		})
+	}
+
+	return p.record(plannedWrite{
+		Action:    "delete",
+		Endpoint:  fmt.Sprintf("%s(%s)", entitySet, id),
+		InvoiceID: id,
+		Reason:    "roll back invoice that could not be completed",
+	})
+}
+
+// ExecuteBatchContext skriver varje operation i batchen som en egen rad. Skapade fakturor
+// får ett påhittat ID i OData-EntityId, precis som vid CreateRecordContext.
+func (p *planRecorder) ExecuteBatchContext(ctx context.Context, batch *dynamics.Batch) error {
+	for _, op := range batch.Operations() {
+		write := plannedWrite{
+			Action:   "batch " + strings.ToLower(op.Method),
+			Endpoint: op.Endpoint,
+			Reason:   "batched request",
+			Body:     op.Body,
+		}
+		op.StatusCode = http.StatusNoContent
+		op.ResponseHeader = http.Header{}
+
+		switch body := op.Body.(type) {
+		case dynamics.Record:
+			documentNumber := p.documentNumber(body)
+			write.Action = "create"
+			write.DocumentNumber = documentNumber
+			write.Reason = "invoice does not exist in Dynamics 365"
+			if op.Method == http.MethodPatch {
+				write.Action = "upsert"
+				write.Reason = "create or update invoice by document number"
+			}
+			entitySet, _, _ := strings.Cut(op.Endpoint, "(")
+			op.ResponseHeader.Set("OData-EntityId", fmt.Sprintf("%s(%s%s)", entitySet, dryRunIDPrefix, documentNumber))
+		case map[string]interface{}:
+			write.Action = "update"
+			write.Reason = changedFields(body)
+		}
+
+		if err := p.record(write); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// changedFields beskriver de ändrade kolumnerna i en uppdatering
+func changedFields(changes map[string]interface{}) string {
+	fields := make([]string, 0, len(changes))
+	for field := range changes {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	return "changed fields: " + strings.Join(fields, ", ")
+}
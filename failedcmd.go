@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"fortnox_dynamics_integration/pkg/fortnox"
+)
+
+// runFailed hanterar kommandot "failed":
+//
+//	failed list [--json]   visa fakturor som inte kunde synkroniseras
+func runFailed(args []string) {
+	if len(args) == 0 || args[0] != "list" {
+		log.Fatal("usage: failed list [--json]")
+	}
+
+	fs := flag.NewFlagSet("failed list", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the failure records as JSON")
+	fs.Parse(args[1:])
+
+	store, err := openStore()
+	if err != nil {
+		log.Fatalf("Failed to open sync state: %v", err)
+	}
+	failures := store.Failures()
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(failures); err != nil {
+			log.Fatalf("Failed to encode failures: %v", err)
+		}
+		return
+	}
+
+	documentNumbers := make([]string, 0, len(failures))
+	for documentNumber := range failures {
+		documentNumbers = append(documentNumbers, documentNumber)
+	}
+	sort.Strings(documentNumbers)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "DOCUMENT\tSTAGE\tATTEMPTS\tLAST FAILED\tERROR")
+	for _, documentNumber := range documentNumbers {
+		f := failures[documentNumber]
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n", documentNumber, f.Stage, f.Attempts, f.LastFailedAt.Local().Format(fortnoxTimeLayout), f.Error)
+	}
+	w.Flush()
+}
+
+// runRetryFailed hanterar kommandot "retry-failed", som synkroniserar om just de fakturor
+// som har misslyckats. Fakturorna tas från lagret så som de såg ut i Fortnox vid försöket,
+// och vattenstämpeln påverkas inte.
+func runRetryFailed(args []string) {
+	fs := flag.NewFlagSet("retry-failed", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "print planned Dynamics 365 writes as JSON lines on stdout instead of performing them")
+	headless := fs.Bool("headless", false, "authorize Fortnox without a browser if authorization is needed")
+	fs.Parse(args)
+
+	invoiceMapping, err := loadMapping()
+	if err != nil {
+		log.Fatalf("Failed to load field mapping: %v", err)
+	}
+
+	store, err := openStore()
+	if err != nil {
+		log.Fatalf("Failed to open sync state: %v", err)
+	}
+
+	var invoices []fortnox.Invoice
+	for documentNumber, f := range store.Failures() {
+		var invoice fortnox.Invoice
+		if err := json.Unmarshal(f.Invoice, &invoice); err != nil {
+			log.Printf("Skipping failed invoice %s without a usable invoice record: %v", documentNumber, err)
+			continue
+		}
+		invoices = append(invoices, invoice)
+	}
+	if len(invoices) == 0 {
+		log.Println("No failed invoices to retry")
+		return
+	}
+
+	fortnoxClient, err := fortnox.NewFortnoxClient()
+	if err != nil {
+		log.Fatalf("Failed to create Fortnox client: %v", err)
+	}
+	if err := ensureAuthorized(fortnoxClient, *headless); err != nil {
+		log.Fatalf("Failed to start authorization flow: %v", err)
+	}
+
+	stopping, aborting, release := shutdownContexts()
+	defer release()
+
+	s, err := newSyncer(stopping, fortnoxClient, store, invoiceMapping, *dryRun)
+	if err != nil {
+		log.Fatalf("Failed to set up Dynamics client: %v", err)
+	}
+
+	startTime := time.Now()
+	log.Printf("Retrying %d failed invoices", len(invoices))
+	result := s.run(stopping, aborting, invoices)
+	log.Printf("Retried %d invoices in %s, %d still failing", len(invoices), time.Since(startTime), result.failed.Load())
+
+	if *dryRun {
+		return
+	}
+	if err := store.Save(); err != nil {
+		log.Fatalf("Failed to save sync state: %v", err)
+	}
+}
@@ -2,7 +2,13 @@ module fortnox_dynamics_integration
 
 go 1.22.3
 
-require github.com/go-resty/resty/v2 v2.13.1
+require (
+	github.com/go-resty/resty/v2 v2.13.1
+	gopkg.in/yaml.v3 v3.0.1
+	software.sslmate.com/src/go-pkcs12 v0.5.0
+)
+
+require golang.org/x/crypto v0.23.0 // indirect
 
 require (
 	github.com/joho/godotenv v1.5.1
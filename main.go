@@ -1,171 +1,284 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"flag"
 	"fmt"
 	"log"
-	"sync"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 	"time"
 
-	"fortnox_dynamics_integration/pkg/fortnox"
 	"fortnox_dynamics_integration/pkg/dynamics"
+	"fortnox_dynamics_integration/pkg/fortnox"
+	"fortnox_dynamics_integration/pkg/mapping"
+	"fortnox_dynamics_integration/pkg/state"
 )
 
 const (
-	numWorkers     = 5                     // Antalet goroutines som ska köras parallellt
-	rateLimit      = 25                    // Max antal förfrågningar per period
-	rateLimitPeriod = 5 * time.Second      // Perioden för rate limiting
+	numWorkers        = 5                  // Antalet goroutines som ska köras parallellt
+	defaultStateFile  = "sync_state.json"  // Fil för synkroniseringsstatus om SYNC_STATE_FILE saknas
+	watermarkOverlap  = time.Minute        // Överlapp mot förra körningen, Fortnox filtrerar på hela minuter
+	fortnoxTimeLayout = "2006-01-02 15:04" // Format för lastmodified i Fortnox API
+	defaultBatchSize  = 50                 // Fakturor per $batch-anrop om SYNC_BATCH_SIZE saknas
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "auth":
+			runAuth(os.Args[2:])
+			return
+		case "failed":
+			runFailed(os.Args[2:])
+			return
+		case "retry-failed":
+			runRetryFailed(os.Args[2:])
+			return
+		case "validate":
+			runValidate(os.Args[2:])
+			return
+		case "customers":
+			runCustomers(os.Args[2:])
+			return
+		}
+	}
+
+	full := flag.Bool("full", false, "ignore the saved watermark and resync all invoices")
+	since := flag.String("since", "", "only sync invoices modified since this time (YYYY-MM-DD or YYYY-MM-DD HH:MM)")
+	fromDate := flag.String("from", "", "only sync invoices dated on or after this date (YYYY-MM-DD)")
+	toDate := flag.String("to", "", "only sync invoices dated on or before this date (YYYY-MM-DD)")
+	dryRun := flag.Bool("dry-run", false, "print planned Dynamics 365 writes as JSON lines on stdout instead of performing them")
+	headless := flag.Bool("headless", false, "authorize Fortnox without a browser if authorization is needed")
+	flag.Parse()
+
+	// Läs mappningen först, så att en felaktig mappningsfil upptäcks innan något hämtas
+	invoiceMapping, err := loadMapping()
+	if err != nil {
+		log.Fatalf("Failed to load field mapping: %v", err)
+	}
+
 	fortnoxClient, err := fortnox.NewFortnoxClient()
 	if err != nil {
 		log.Fatalf("Failed to create Fortnox client: %v", err)
 	}
 
 	// Om vi inte har en giltig access token, behöver vi starta auktoriseringsflödet
-	if fortnoxClient.AccessToken == "" || time.Now().After(fortnoxClient.ExpiresAt) {
-		log.Println("Starting authorization flow")
-		err := fortnoxClient.StartAuthorizationFlow()
-		if err != nil {
-			log.Fatalf("Failed to start authorization flow: %v", err)
-		}
+	if err := ensureAuthorized(fortnoxClient, *headless); err != nil {
+		log.Fatalf("Failed to start authorization flow: %v", err)
+	}
+
+	// Öppna lagret med redan synkroniserade fakturor
+	store, err := openStore()
+	if err != nil {
+		log.Fatalf("Failed to open sync state: %v", err)
 	}
 
-	// Filtrering och sortering om det behövs
-	filters := map[string]string{
-		// "lastmodified": "2023-01-01", // exempel på filter
+	// Filtrering utifrån flaggor och sparad vattenstämpel
+	filters, backfill, err := buildFilters(store, *full, *since, *fromDate, *toDate)
+	if err != nil {
+		log.Fatalf("Invalid filter flags: %v", err)
 	}
 
+	// Första SIGINT/SIGTERM slutar påbörja nya fakturor, en andra avbryter även pågående anrop
+	stopping, aborting, release := shutdownContexts()
+	defer release()
+
 	// Nu kan vi använda klienten för att göra API-anrop
 	startTime := time.Now()
-	invoices, err := fortnoxClient.FetchInvoices(filters)
+	invoices, err := fortnoxClient.FetchInvoicesContext(stopping, filters)
 	if err != nil {
 		log.Fatalf("Failed to fetch invoices: %v", err)
 	}
 	elapsedTime := time.Since(startTime)
-	fmt.Printf("Fetched %d invoices in %s\n", len(invoices), elapsedTime)
+	log.Printf("Fetched %d invoices in %s", len(invoices), elapsedTime)
 
 	// Skapa Dynamics 365 klient
-	dynamicsClient := dynamics.NewD365Client()
-	if err := dynamicsClient.AuthenticateApi(); err != nil {
-		log.Fatalf("Failed to authenticate Dynamics client: %v", err)
+	s, err := newSyncer(stopping, fortnoxClient, store, invoiceMapping, *dryRun)
+	if err != nil {
+		log.Fatalf("Failed to set up Dynamics client: %v", err)
 	}
 
-	invoiceChan := make(chan fortnox.Invoice, len(invoices))
-	var wg sync.WaitGroup
+	result := s.run(stopping, aborting, invoices)
 
-	for i := 0; i < numWorkers; i++ {
-		wg.Add(1)
-		go worker(fortnoxClient, dynamicsClient, invoiceChan, &wg)
+	// En torrkörning får inte påverka sparad status
+	if *dryRun {
+		log.Printf("Dry run finished, %d invoices failed", result.failed.Load())
+		return
 	}
 
-	for _, invoice := range invoices {
-		invoiceChan <- invoice
+	// Misslyckade fakturor är sparade i lagret och körs igen med "retry-failed", så bestående
+	// fel håller inte kvar vattenstämpeln. Den flyttas inte fram vid ett avbrott, vid
+	// tillfälliga fel som kan gå igenom vid nästa körning eller vid en bakåtfyllnad.
+	if n := result.temporary.Load(); n > 0 {
+		log.Printf("%d invoices failed with temporary errors, keeping previous watermark", n)
+	} else if stopping.Err() != nil {
+		log.Println("Sync was interrupted, keeping previous watermark")
+	} else if !backfill {
+		if n := result.failed.Load(); n > 0 {
+			log.Printf("%d invoices failed and were saved for retry-failed, advancing watermark", n)
+		}
+		store.SetWatermark(startTime)
 	}
-	close(invoiceChan)
 
-	wg.Wait()
+	if err := store.Save(); err != nil {
+		log.Fatalf("Failed to save sync state: %v", err)
+	}
 }
 
-func worker(fortnoxClient *fortnox.FortnoxClient, dynamicsClient *dynamics.D365, invoices <-chan fortnox.Invoice, wg *sync.WaitGroup) {
-	defer wg.Done()
-
-	ticker := time.NewTicker(rateLimitPeriod / rateLimit)
-	defer ticker.Stop()
+// openStore öppnar lagret med synkroniseringsstatus, SYNC_STATE_FILE eller defaultStateFile
+func openStore() (*state.Store, error) {
+	stateFile := os.Getenv("SYNC_STATE_FILE")
+	if stateFile == "" {
+		stateFile = defaultStateFile
+	}
+	return state.Open(stateFile)
+}
 
-	for invoice := range invoices {
-		<-ticker.C
-		startTime := time.Now()
-		processInvoice(fortnoxClient, dynamicsClient, invoice)
-		elapsedTime := time.Since(startTime)
-		fmt.Printf("Processed invoice %s in %s\n", invoice.DocumentNumber, elapsedTime)
+// loadMapping läser och validerar fältmappningen i SYNC_MAPPING_FILE. Utan mappningsfil
+// används mapping.Default, som skriver till new_fakturas.
+func loadMapping() (*mapping.Mapping, error) {
+	mappingFile := os.Getenv("SYNC_MAPPING_FILE")
+	if mappingFile == "" {
+		return mapping.Default(), nil
 	}
+	return mapping.Load(mappingFile)
 }
 
-func processInvoice(fortnoxClient *fortnox.FortnoxClient, dynamicsClient *dynamics.D365, invoice fortnox.Invoice) {
-	// Kontrollera om fakturan redan finns i Dynamics 365
-	existingInvoiceID, err := dynamicsClient.SearchInvoice(invoice.DocumentNumber)
-	if err != nil {
-		log.Printf("Failed to search invoice for document number %s: %v", invoice.DocumentNumber, err)
-		return
+// newSyncer skapar och autentiserar Dynamics 365-klienten. Vid dryRun skrivs de
+// planerade anropen till stdout istället för att utföras. SYNC_BATCH_SIZE anger hur
+// många fakturor som skrivs per $batch-anrop, där 1 skriver varje faktura för sig.
+// DYNAMICS_INVOICE_ALTERNATE_KEY=true skriver nya fakturor med upsert på mappningens
+// nyckelkolumn, vilket kräver en alternativ nyckel på den kolumnen i Dynamics 365.
+// SYNC_CREATE_MISSING_CUSTOMERS=true skapar kontot för fakturor vars kund saknas i
+// Dynamics 365, enligt avsnittet accounts i fältmappningen.
+func newSyncer(ctx context.Context, fortnoxClient *fortnox.FortnoxClient, store *state.Store, invoiceMapping *mapping.Mapping, dryRun bool) (*syncer, error) {
+	batchSize := defaultBatchSize
+	if value := os.Getenv("SYNC_BATCH_SIZE"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > 1000 {
+			return nil, fmt.Errorf("invalid SYNC_BATCH_SIZE %q, expected a number from 1 to 1000", value)
+		}
+		batchSize = n
 	}
 
-	if existingInvoiceID != "" {
-		log.Printf("Invoice %s already exists in Dynamics 365", invoice.DocumentNumber)
-		return
+	createCustomers := os.Getenv("SYNC_CREATE_MISSING_CUSTOMERS") == "true"
+	if createCustomers && invoiceMapping.Accounts == nil {
+		return nil, fmt.Errorf("SYNC_CREATE_MISSING_CUSTOMERS requires an accounts section in the field mapping")
+	}
+	if createCustomers {
+		warnUnmappedAccountFields(invoiceMapping.Accounts)
 	}
 
-	// Sök efter kund i Dynamics 365
-	customersData, err := dynamicsClient.SearchCustomer(invoice.CustomerNumber)
+	dynamicsClient, err := newDynamicsClient()
 	if err != nil {
-		log.Printf("Failed to search customer for customer number %s, document number %s: %v", invoice.CustomerNumber, invoice.DocumentNumber, err)
-		return
+		return nil, err
+	}
+	if err := dynamicsClient.AuthenticateApiContext(ctx); err != nil {
+		return nil, fmt.Errorf("failed to authenticate: %w", err)
 	}
 
-	var customers struct {
-		Value []struct {
-			CustomerID string `json:"@odata.id"`
-			AccountID  string `json:"accountid"`
-		} `json:"value"`
+	s := &syncer{
+		fortnox:  fortnoxClient,
+		dynamics: dynamicsClient,
+		writer:   dynamicsClient,
+		store:    store,
+		mapping:  invoiceMapping,
+
+		batchSize:       batchSize,
+		upsert:          os.Getenv("DYNAMICS_INVOICE_ALTERNATE_KEY") == "true",
+		createCustomers: createCustomers,
+		saveProgress:    store != nil && !dryRun,
 	}
-	err = json.Unmarshal(customersData, &customers)
-	if err != nil {
-		log.Printf("Failed to unmarshal customers for customer number %s, document number %s: %v", invoice.CustomerNumber, invoice.DocumentNumber, err)
-		return
+	if dryRun {
+		s.writer = newPlanRecorder(os.Stdout, invoiceMapping)
 	}
+	return s, nil
+}
 
-	if len(customers.Value) == 0 {
-		log.Printf("No customer found for customer number %s, document number %s", invoice.CustomerNumber, invoice.DocumentNumber)
-		return
+// newDynamicsClient skapar Dynamics 365-klienten. En ogiltig DYNAMICS_REQUEST_TIMEOUT är ett
+// fel, precis som FORTNOX_REQUEST_TIMEOUT, istället för att tyst ge standardvärdet.
+func newDynamicsClient() (*dynamics.D365, error) {
+	if timeout := os.Getenv("DYNAMICS_REQUEST_TIMEOUT"); timeout != "" {
+		if _, err := time.ParseDuration(timeout); err != nil {
+			return nil, fmt.Errorf("invalid DYNAMICS_REQUEST_TIMEOUT: %v", err)
+		}
 	}
+	return dynamics.NewD365Client(), nil
+}
 
-	customerID := customers.Value[0].AccountID
+// shutdownContexts returnerar två kontexter. stopping avbryts vid första SIGINT eller SIGTERM,
+// så att inga nya fakturor påbörjas medan de pågående körs klart. aborting avbryts vid
+// en andra signal och avbryter då även pågående anrop mot Fortnox och Dynamics 365.
+func shutdownContexts() (stopping, aborting context.Context, release func()) {
+	stopping, stop := context.WithCancel(context.Background())
+	aborting, abort := context.WithCancel(context.Background())
 
-	// Hämta PDF för fakturan
-	invoicePDF, err := fortnoxClient.FetchInvoicePDF(invoice.DocumentNumber)
-	if err != nil {
-		log.Printf("Failed to fetch invoice PDF for document number %s: %v", invoice.DocumentNumber, err)
-		return
-	}
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
 
-	// Förbered data för Dynamics 365
-	invoiceNumber := fmt.Sprintf("%s-%s", invoice.InvoiceDate, invoice.DocumentNumber)
-	dynamicsInvoice := dynamics.DynamicsInvoice{
-		InvoiceNumber:  invoiceNumber,
-		Balance:        invoice.Balance,
-		Booked:         invoice.Booked,
-		Canceled:       invoice.Cancelled,
-		DocumentNumber: invoice.DocumentNumber,
-		DueDate:        invoice.DueDate,
-		InvoiceDate:    invoice.InvoiceDate,
-		Total:          invoice.Total,
-		Distributor:    100000001,
-	}
+	go func() {
+		if _, ok := <-signals; !ok {
+			return
+		}
+		log.Println("Stopping, waiting for invoices in progress (signal again to abort)")
+		stop()
 
-	// Spara faktura till Dynamics 365
-	invoiceID, err := dynamicsClient.CreateInvoice(dynamicsInvoice)
-	if err != nil {
-		log.Printf("Failed to save invoice for customer number %s, document number %s to Dynamics 365: %v", invoice.CustomerNumber, invoice.DocumentNumber, err)
-		return
-	}
+		if _, ok := <-signals; !ok {
+			return
+		}
+		log.Println("Aborting invoices in progress")
+		abort()
+	}()
 
-	// Ladda upp PDF-filen till Dynamics 365
-	err = dynamicsClient.UploadFile(invoiceID, "new_invoicepdf", fmt.Sprintf("%s.pdf", invoiceNumber), invoicePDF)
-	if err != nil {
-		log.Printf("Failed to upload invoice PDF for invoice ID %s, document number %s to Dynamics 365: %v", invoiceID, invoice.DocumentNumber, err)
-		return
+	return stopping, aborting, func() {
+		signal.Stop(signals)
+		close(signals)
+		stop()
+		abort()
 	}
+}
+
+// buildFilters tar fram filtren till FetchInvoices. Den returnerar även om körningen
+// är en bakåtfyllnad av ett specifikt fönster, vilket inte ska flytta vattenstämpeln.
+func buildFilters(store *state.Store, full bool, since, fromDate, toDate string) (map[string]string, bool, error) {
+	filters := map[string]string{}
+	backfill := false
 
-	// Associera fakturan med kundkontot
-	associateBody := map[string]string{
-		"@odata.id": fmt.Sprintf("%s/api/data/v9.2/accounts(%s)", dynamicsClient.URL, customerID),
+	switch {
+	case since != "":
+		t, err := parseSince(since)
+		if err != nil {
+			return nil, false, err
+		}
+		filters["lastmodified"] = t.Format(fortnoxTimeLayout)
+		backfill = true
+	case !full && !store.Watermark().IsZero():
+		filters["lastmodified"] = store.Watermark().Add(-watermarkOverlap).Format(fortnoxTimeLayout)
 	}
-	_, err = dynamicsClient.PostRequest(fmt.Sprintf("new_fakturas(%s)/new_customer_account/$ref", invoiceID), associateBody)
-	if err != nil {
-		log.Printf("Failed to associate invoice ID %s with customer ID %s for document number %s: %v", invoiceID, customerID, invoice.DocumentNumber, err)
-		return
+
+	for key, value := range map[string]string{"fromdate": fromDate, "todate": toDate} {
+		if value == "" {
+			continue
+		}
+		if _, err := time.Parse("2006-01-02", value); err != nil {
+			return nil, false, fmt.Errorf("invalid %s %q: %v", key, value, err)
+		}
+		filters[key] = value
+		backfill = true
 	}
 
-	fmt.Printf("Processed invoice %s for customer %s\n", invoice.DocumentNumber, invoice.CustomerNumber)
+	return filters, backfill, nil
+}
+
+// parseSince tolkar --since som antingen ett datum eller datum och tid i lokal tid
+func parseSince(value string) (time.Time, error) {
+	for _, layout := range []string{fortnoxTimeLayout, "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid --since %q, expected YYYY-MM-DD or YYYY-MM-DD HH:MM", value)
 }
@@ -3,7 +3,6 @@
 package main
 
 import (
-    "encoding/json"
     "fmt"
     "log"
     "os"
@@ -38,27 +37,16 @@ func main() {
     customerNumber := "A44000" // Ale Folkets Hus
 
     // Sök efter kund i Dynamics 365
-    customersData, err := dynamicsClient.SearchCustomer(customerNumber)
+    account, err := dynamicsClient.FindAccountByCustomerNumber(customerNumber)
     if err != nil {
         log.Fatalf("Failed to search customer: %v", err)
     }
 
-    var customers struct {
-        Value []struct {
-            CustomerID string `json:"@odata.id"`
-            AccountID  string `json:"accountid"`
-        } `json:"value"`
-    }
-    err = json.Unmarshal(customersData, &customers)
-    if err != nil {
-        log.Fatalf("Failed to unmarshal customers: %v", err)
-    }
-
-    if len(customers.Value) == 0 {
+    if account == nil {
         log.Fatalf("No customer found for customer number: %s", customerNumber)
     }
 
-    customerID := customers.Value[0].AccountID
+    customerID := account.ID
 
     mockInvoice := dynamics.DynamicsInvoice{
         InvoiceNumber:  "2024-06-24-12345",
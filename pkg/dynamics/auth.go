@@ -1,29 +1,114 @@
 package dynamics
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"strings"
+	"time"
 )
 
+const (
+	defaultAuthorityHost = "https://login.microsoftonline.com"
 
+	// Authentication methods selectable with DYNAMICS_AUTH_METHOD
+	AuthMethodSecret      = "secret"
+	AuthMethodCertificate = "certificate"
+
+	// Token endpoint versions selectable with DYNAMICS_AUTH_ENDPOINT
+	AuthEndpointV1 = "v1"
+	AuthEndpointV2 = "v2"
+
+	clientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+)
 
 // AuthenticateApi performs OAuth authentication to obtain an access token
 func (d *D365) AuthenticateApi() error {
+	return d.AuthenticateApiContext(context.Background())
+}
+
+// AuthenticateApiContext is like AuthenticateApi but carries a context
+func (d *D365) AuthenticateApiContext(ctx context.Context) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.authenticate(ctx)
+}
+
+// tokenEndpoint returns the Azure AD token endpoint for the configured authority and endpoint version
+func (d *D365) tokenEndpoint() string {
+	host := strings.TrimRight(d.AuthorityHost, "/")
+	if host == "" {
+		host = defaultAuthorityHost
+	}
+	if d.AuthEndpoint == AuthEndpointV2 {
+		return host + "/" + d.TenantID + "/oauth2/v2.0/token"
+	}
+	return host + "/" + d.TenantID + "/oauth2/token"
+}
+
+// tokenForm builds the client credentials request for the configured endpoint version and credential type
+func (d *D365) tokenForm(endpoint string) (map[string]string, error) {
+	form := map[string]string{
+		"client_id":  d.ClientID,
+		"grant_type": "client_credentials",
+	}
+
+	// The v2.0 endpoint takes a scope instead of the v1 resource parameter
+	if d.AuthEndpoint == AuthEndpointV2 {
+		form["scope"] = strings.TrimRight(d.URL, "/") + "/.default"
+	} else {
+		form["resource"] = d.URL
+	}
+
+	switch d.AuthMethod {
+	case "", AuthMethodSecret:
+		form["client_secret"] = d.ClientSecret
+	case AuthMethodCertificate:
+		if d.certificate == nil {
+			cert, err := LoadClientCertificate(d.CertificateFile, d.CertificateKeyFile, d.CertificatePassword)
+			if err != nil {
+				return nil, err
+			}
+			d.certificate = cert
+		}
+		assertion, err := d.certificate.Assertion(d.ClientID, endpoint)
+		if err != nil {
+			return nil, err
+		}
+		form["client_assertion_type"] = clientAssertionType
+		form["client_assertion"] = assertion
+	default:
+		return nil, fmt.Errorf("unknown Dynamics 365 auth method %q", d.AuthMethod)
+	}
+
+	return form, nil
+}
+
+// authenticate obtains a new access token and records when it expires.
+// The caller must hold d.mu.
+func (d *D365) authenticate(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, d.requestTimeout())
+	defer cancel()
+
+	endpoint := d.tokenEndpoint()
+	form, err := d.tokenForm(endpoint)
+	if err != nil {
+		return fmt.Errorf("error preparing Dynamics 365 authentication: %v", err)
+	}
+
 	resp, err := d.Resty.R().
+		SetContext(ctx).
 		SetHeader("Content-Type", "application/x-www-form-urlencoded").
-		SetFormData(map[string]string{
-			"client_id":     d.ClientID,
-			"resource":      d.URL,
-			"client_secret": d.ClientSecret,
-			"grant_type":    "client_credentials"}).
-		Post("https://login.microsoftonline.com/" + d.TenantID + "/oauth2/token")
+		SetFormData(form).
+		Post(endpoint)
 
 	if err != nil {
-		return fmt.Errorf("error obtaining access token from Dynamics 365: %v", err)
+		return fmt.Errorf("error obtaining access token from Dynamics 365: %w", err)
 	}
 
 	if resp.StatusCode() != 200 {
-		return fmt.Errorf("failed to authenticate: %v", resp.String())
+		return fmt.Errorf("failed to authenticate: %s", resp.String())
 	}
 
 	token := Token{}
@@ -31,8 +116,12 @@ func (d *D365) AuthenticateApi() error {
 		return fmt.Errorf("error parsing access token JSON: %v", err)
 	}
 
+	expiresIn, err := token.ExpiresIn.Int64()
+	if err != nil {
+		return fmt.Errorf("error parsing token expiry %q: %v", token.ExpiresIn, err)
+	}
+
 	d.AccessToken = token.AccessToken
+	d.ExpiresAt = time.Now().Add(time.Duration(expiresIn)*time.Second - tokenExpiryMargin)
 	return nil
 }
-
-
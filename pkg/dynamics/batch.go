@@ -0,0 +1,433 @@
+package dynamics
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// maxBatchOperations is the most operations Dynamics 365 accepts in one $batch request
+const maxBatchOperations = 1000
+
+// ErrNotExecuted is set on batch operations that Dynamics 365 did not run, because an
+// earlier operation failed and the batch was not sent with ContinueOnError
+var ErrNotExecuted = errors.New("batch operation was not executed")
+
+// Batch collects operations that are sent to Dynamics 365 in a single $batch request.
+// Build it with the Get, Post, Patch, Delete and ChangeSet methods, run it with
+// D365.ExecuteBatch and read the result of each operation from the returned operations.
+type Batch struct {
+	ContinueOnError bool // Run the remaining operations after one outside a change set has failed
+
+	items []batchItem
+}
+
+// batchItem is either a single operation or a change set
+type batchItem struct {
+	op        *BatchOperation
+	changeSet *ChangeSet
+}
+
+// ChangeSet groups write operations in a batch that succeed or fail together
+type ChangeSet struct {
+	batch *Batch
+	ops   []*BatchOperation
+}
+
+// BatchOperation is one request in a batch and, once the batch has run, its response
+type BatchOperation struct {
+	Method   string
+	Endpoint string      // Relative to the Web API root, or "$n" to refer to operation n in the same change set
+	Body     interface{} // Encoded as JSON, nil for none
+	Header   http.Header // Additional request headers
+
+	contentID int
+
+	StatusCode     int
+	ResponseHeader http.Header
+	Response       []byte
+	Err            error // An *ODataError for an error status, or ErrNotExecuted
+}
+
+// NewBatch creates an empty batch
+func NewBatch() *Batch {
+	return &Batch{}
+}
+
+// Get adds a GET request to the batch
+func (b *Batch) Get(endpoint string) *BatchOperation {
+	return b.add(&BatchOperation{Method: resty.MethodGet, Endpoint: endpoint})
+}
+
+// Post adds a POST request to the batch
+func (b *Batch) Post(endpoint string, body interface{}) *BatchOperation {
+	return b.add(&BatchOperation{Method: resty.MethodPost, Endpoint: endpoint, Body: body})
+}
+
+// Patch adds a PATCH request to the batch
+func (b *Batch) Patch(endpoint string, body interface{}) *BatchOperation {
+	return b.add(&BatchOperation{Method: resty.MethodPatch, Endpoint: endpoint, Body: body})
+}
+
+// Delete adds a DELETE request to the batch
+func (b *Batch) Delete(endpoint string) *BatchOperation {
+	return b.add(&BatchOperation{Method: resty.MethodDelete, Endpoint: endpoint})
+}
+
+func (b *Batch) add(op *BatchOperation) *BatchOperation {
+	b.items = append(b.items, batchItem{op: op})
+	return op
+}
+
+// ChangeSet adds a change set to the batch. Operations added to it run in one transaction.
+func (b *Batch) ChangeSet() *ChangeSet {
+	cs := &ChangeSet{batch: b}
+	b.items = append(b.items, batchItem{changeSet: cs})
+	return cs
+}
+
+// Post adds a POST request to the change set
+func (cs *ChangeSet) Post(endpoint string, body interface{}) *BatchOperation {
+	return cs.add(&BatchOperation{Method: resty.MethodPost, Endpoint: endpoint, Body: body})
+}
+
+// Patch adds a PATCH request to the change set
+func (cs *ChangeSet) Patch(endpoint string, body interface{}) *BatchOperation {
+	return cs.add(&BatchOperation{Method: resty.MethodPatch, Endpoint: endpoint, Body: body})
+}
+
+// Delete adds a DELETE request to the change set
+func (cs *ChangeSet) Delete(endpoint string) *BatchOperation {
+	return cs.add(&BatchOperation{Method: resty.MethodDelete, Endpoint: endpoint})
+}
+
+func (cs *ChangeSet) add(op *BatchOperation) *BatchOperation {
+	op.contentID = cs.batch.Len() + 1
+	cs.ops = append(cs.ops, op)
+	return op
+}
+
+// Len returns the number of operations in the batch, counting each operation in a change set
+func (b *Batch) Len() int {
+	n := 0
+	for _, item := range b.items {
+		if item.changeSet != nil {
+			n += len(item.changeSet.ops)
+		} else {
+			n++
+		}
+	}
+	return n
+}
+
+// Operations returns all operations in the order they were added
+func (b *Batch) Operations() []*BatchOperation {
+	ops := make([]*BatchOperation, 0, b.Len())
+	for _, item := range b.items {
+		if item.changeSet != nil {
+			ops = append(ops, item.changeSet.ops...)
+		} else {
+			ops = append(ops, item.op)
+		}
+	}
+	return ops
+}
+
+// Reference returns the endpoint that refers to the record created by this operation,
+// usable by later operations in the same change set
+func (op *BatchOperation) Reference() string {
+	return fmt.Sprintf("$%d", op.contentID)
+}
+
+// EntityID returns the ID of the record created or updated by the operation, read from
+// the OData-EntityId response header
+func (op *BatchOperation) EntityID() string {
+	return entityIDFromHeader(op.ResponseHeader)
+}
+
+// entityIDFromHeader returns the record ID at the end of the OData-EntityId header
+func entityIDFromHeader(header http.Header) string {
+	entityID := header.Get("OData-EntityId")
+	start := strings.LastIndex(entityID, "(")
+	if start < 0 || !strings.HasSuffix(entityID, ")") {
+		return ""
+	}
+	return entityID[start+1 : len(entityID)-1]
+}
+
+// ExecuteBatch sends the batch to Dynamics 365 and stores the result of every operation in it
+func (d *D365) ExecuteBatch(b *Batch) error {
+	return d.ExecuteBatchContext(context.Background(), b)
+}
+
+// ExecuteBatchContext is like ExecuteBatch but carries a context.
+// The returned error covers the batch request as a whole; failed operations
+// have their own error in BatchOperation.Err.
+func (d *D365) ExecuteBatchContext(ctx context.Context, b *Batch) error {
+	if b.Len() == 0 {
+		return nil
+	}
+	if b.Len() > maxBatchOperations {
+		return fmt.Errorf("batch has %d operations, at most %d are allowed", b.Len(), maxBatchOperations)
+	}
+
+	body, boundary, err := b.encode(d.URL + "/api/data/v9.2/")
+	if err != nil {
+		return fmt.Errorf("failed to encode batch: %w", err)
+	}
+
+	resp, err := d.do(ctx, resty.MethodPost, "$batch", func(r *resty.Request) *resty.Request {
+		r = r.
+			SetHeader("Content-Type", "multipart/mixed; boundary="+boundary).
+			SetHeader("Accept", "application/json").
+			SetHeader("OData-MaxVersion", "4.0").
+			SetHeader("OData-Version", "4.0").
+			SetBody(body)
+		if b.ContinueOnError {
+			r.SetHeader("Prefer", "odata.continue-on-error")
+		}
+		return r
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode() != 200 {
+		return newODataError(resp.StatusCode(), resp.Body())
+	}
+
+	if err := b.decode(resp.Header().Get("Content-Type"), resp.Body()); err != nil {
+		return fmt.Errorf("failed to parse batch response: %w", err)
+	}
+	return nil
+}
+
+// encode writes the batch as a multipart/mixed request body and returns it with its boundary
+func (b *Batch) encode(baseURL string) ([]byte, string, error) {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+
+	for _, item := range b.items {
+		if item.op != nil {
+			if err := writeOperation(w, item.op, baseURL); err != nil {
+				return nil, "", err
+			}
+			continue
+		}
+
+		var changeSet bytes.Buffer
+		cw := multipart.NewWriter(&changeSet)
+		for _, op := range item.changeSet.ops {
+			if err := writeOperation(cw, op, baseURL); err != nil {
+				return nil, "", err
+			}
+		}
+		if err := cw.Close(); err != nil {
+			return nil, "", err
+		}
+
+		part, err := w.CreatePart(textproto.MIMEHeader{
+			"Content-Type": {"multipart/mixed; boundary=" + cw.Boundary()},
+		})
+		if err != nil {
+			return nil, "", err
+		}
+		if _, err := part.Write(changeSet.Bytes()); err != nil {
+			return nil, "", err
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), w.Boundary(), nil
+}
+
+// writeOperation writes one operation as an application/http part
+func writeOperation(w *multipart.Writer, op *BatchOperation, baseURL string) error {
+	header := textproto.MIMEHeader{
+		"Content-Type":              {"application/http"},
+		"Content-Transfer-Encoding": {"binary"},
+	}
+	if op.contentID > 0 {
+		header.Set("Content-ID", strconv.Itoa(op.contentID))
+	}
+	part, err := w.CreatePart(header)
+	if err != nil {
+		return err
+	}
+
+	target := op.Endpoint
+	if !strings.HasPrefix(target, "$") {
+		target = baseURL + target
+	}
+
+	var req bytes.Buffer
+	fmt.Fprintf(&req, "%s %s HTTP/1.1\r\n", op.Method, target)
+	req.WriteString("Accept: application/json\r\n")
+	for name, values := range op.Header {
+		for _, value := range values {
+			fmt.Fprintf(&req, "%s: %s\r\n", name, value)
+		}
+	}
+	if op.Body != nil {
+		data, err := json.Marshal(op.Body)
+		if err != nil {
+			return err
+		}
+		req.WriteString("Content-Type: application/json; type=entry\r\n")
+		fmt.Fprintf(&req, "Content-Length: %d\r\n\r\n", len(data))
+		req.Write(data)
+	} else {
+		req.WriteString("\r\n")
+	}
+
+	_, err = part.Write(req.Bytes())
+	return err
+}
+
+// decode reads a multipart/mixed batch response and stores the result of every operation
+func (b *Batch) decode(contentType string, body []byte) error {
+	boundary, err := multipartBoundary(contentType)
+	if err != nil {
+		return err
+	}
+
+	r := multipart.NewReader(bytes.NewReader(body), boundary)
+	i := 0
+	for ; ; i++ {
+		part, err := r.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if i >= len(b.items) {
+			return fmt.Errorf("batch response has more parts than the %d sent", len(b.items))
+		}
+
+		item := b.items[i]
+		if item.op != nil {
+			if err := readOperation(part, item.op); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := readChangeSet(part, item.changeSet); err != nil {
+			return err
+		}
+	}
+
+	// Dynamics 365 stops at the first failed operation unless ContinueOnError is set
+	for _, item := range b.items[i:] {
+		if item.op != nil {
+			item.op.Err = ErrNotExecuted
+			continue
+		}
+		for _, op := range item.changeSet.ops {
+			op.Err = ErrNotExecuted
+		}
+	}
+	return nil
+}
+
+// readChangeSet reads the responses of a change set. A change set that failed is answered
+// with a single error response, which then applies to every operation in it.
+func readChangeSet(part *multipart.Part, cs *ChangeSet) error {
+	mediaType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+	if mediaType != "multipart/mixed" {
+		var failed BatchOperation
+		if err := readOperation(part, &failed); err != nil {
+			return err
+		}
+		for _, op := range cs.ops {
+			op.StatusCode, op.ResponseHeader, op.Response, op.Err = failed.StatusCode, failed.ResponseHeader, failed.Response, failed.Err
+		}
+		return nil
+	}
+
+	boundary, err := multipartBoundary(part.Header.Get("Content-Type"))
+	if err != nil {
+		return err
+	}
+
+	r := multipart.NewReader(part, boundary)
+	for i := 0; ; i++ {
+		opPart, err := r.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// Responses carry the Content-ID of their request, otherwise they come in order
+		var op *BatchOperation
+		if id, err := strconv.Atoi(opPart.Header.Get("Content-ID")); err == nil {
+			for _, candidate := range cs.ops {
+				if candidate.contentID == id {
+					op = candidate
+				}
+			}
+		}
+		if op == nil {
+			if i >= len(cs.ops) {
+				return fmt.Errorf("change set response has more parts than the %d sent", len(cs.ops))
+			}
+			op = cs.ops[i]
+		}
+
+		if err := readOperation(opPart, op); err != nil {
+			return err
+		}
+	}
+}
+
+// readOperation reads an application/http response part into op
+func readOperation(part io.Reader, op *BatchOperation) error {
+	resp, err := http.ReadResponse(bufio.NewReader(part), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	op.StatusCode = resp.StatusCode
+	op.ResponseHeader = resp.Header
+	op.Response = data
+	op.Err = nil
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		op.Err = newODataError(resp.StatusCode, data)
+	}
+	return nil
+}
+
+// multipartBoundary returns the boundary parameter of a multipart content type
+func multipartBoundary(contentType string) (string, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(mediaType, "multipart/") || params["boundary"] == "" {
+		return "", fmt.Errorf("unexpected content type %q", contentType)
+	}
+	return params["boundary"], nil
+}
@@ -0,0 +1,274 @@
+package dynamics
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// crlf converts a response written with \n line endings to the \r\n that Dynamics 365 sends
+func crlf(s string) []byte {
+	return []byte(strings.ReplaceAll(s, "\n", "\r\n"))
+}
+
+const batchContentType = "multipart/mixed; boundary=batchresponse_5f4e4b2a-9d1c-4c59-8d3b-1d2f0f3b6a11"
+
+// continueOnErrorResponse answers a create, a failed update and a get, sent with ContinueOnError
+var continueOnErrorResponse = crlf(`--batchresponse_5f4e4b2a-9d1c-4c59-8d3b-1d2f0f3b6a11
+Content-Type: application/http
+Content-Transfer-Encoding: binary
+
+HTTP/1.1 204 No Content
+OData-Version: 4.0
+Location: https://org.crm4.dynamics.com/api/data/v9.2/new_fakturas(6c2b3f4e-1a2b-ef11-8ee8-000d3ab8c4f1)
+OData-EntityId: https://org.crm4.dynamics.com/api/data/v9.2/new_fakturas(6c2b3f4e-1a2b-ef11-8ee8-000d3ab8c4f1)
+
+
+--batchresponse_5f4e4b2a-9d1c-4c59-8d3b-1d2f0f3b6a11
+Content-Type: application/http
+Content-Transfer-Encoding: binary
+
+HTTP/1.1 404 Not Found
+Content-Type: application/json; odata.metadata=minimal
+OData-Version: 4.0
+
+{"error":{"code":"0x80040217","message":"new_faktura With Id = 00000000-0000-0000-0000-000000000001 Does Not Exist"}}
+--batchresponse_5f4e4b2a-9d1c-4c59-8d3b-1d2f0f3b6a11
+Content-Type: application/http
+Content-Transfer-Encoding: binary
+
+HTTP/1.1 200 OK
+Content-Type: application/json; odata.metadata=minimal
+OData-Version: 4.0
+
+{"@odata.context":"https://org.crm4.dynamics.com/api/data/v9.2/$metadata#accounts(accountid)","value":[{"accountid":"0a8f1e2d-1a2b-ef11-8ee8-000d3ab8c4f1"}]}
+--batchresponse_5f4e4b2a-9d1c-4c59-8d3b-1d2f0f3b6a11--
+`)
+
+func TestDecodeContinueOnError(t *testing.T) {
+	b := NewBatch()
+	b.ContinueOnError = true
+	create := b.Post("new_fakturas", map[string]interface{}{"new_documentnumber": "1"})
+	update := b.Patch("new_fakturas(00000000-0000-0000-0000-000000000001)", map[string]interface{}{"new_total": 10})
+	get := b.Get("accounts?$select=accountid")
+
+	if err := b.decode(batchContentType, continueOnErrorResponse); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+
+	if create.Err != nil || create.StatusCode != http.StatusNoContent {
+		t.Errorf("create = %d, %v, want 204 without error", create.StatusCode, create.Err)
+	}
+	if id := create.EntityID(); id != "6c2b3f4e-1a2b-ef11-8ee8-000d3ab8c4f1" {
+		t.Errorf("create EntityID = %q", id)
+	}
+
+	var odataErr *ODataError
+	if !errors.As(update.Err, &odataErr) {
+		t.Fatalf("update Err = %v, want an ODataError", update.Err)
+	}
+	if update.StatusCode != http.StatusNotFound || !odataErr.NotFound() || odataErr.Code != "0x80040217" {
+		t.Errorf("update = %d, %+v", update.StatusCode, odataErr)
+	}
+
+	if get.Err != nil || get.StatusCode != http.StatusOK {
+		t.Errorf("get = %d, %v, want 200 without error", get.StatusCode, get.Err)
+	}
+	records, err := DecodeCollection[Record](get.Response)
+	if err != nil || len(records) != 1 || records[0]["accountid"] != "0a8f1e2d-1a2b-ef11-8ee8-000d3ab8c4f1" {
+		t.Errorf("get response = %v, %v", records, err)
+	}
+}
+
+// failedChangeSetResponse answers a change set whose second operation failed, followed by
+// nothing, as the batch was sent without ContinueOnError
+var failedChangeSetResponse = crlf(`--batchresponse_5f4e4b2a-9d1c-4c59-8d3b-1d2f0f3b6a11
+Content-Type: application/http
+Content-Transfer-Encoding: binary
+
+HTTP/1.1 400 Bad Request
+Content-Type: application/json; odata.metadata=minimal
+OData-Version: 4.0
+
+{"error":{"code":"0x80048d19","message":"Error identified in Payload provided by the user for Entity :'new_fakturas'"}}
+--batchresponse_5f4e4b2a-9d1c-4c59-8d3b-1d2f0f3b6a11--
+`)
+
+func TestDecodeFailedChangeSet(t *testing.T) {
+	b := NewBatch()
+	cs := b.ChangeSet()
+	first := cs.Post("new_fakturas", map[string]interface{}{"new_documentnumber": "1"})
+	second := cs.Post("new_fakturas", map[string]interface{}{"new_total": "x"})
+	after := b.Patch("new_fakturas(00000000-0000-0000-0000-000000000001)", map[string]interface{}{"new_total": 10})
+	last := b.Delete("new_fakturas(00000000-0000-0000-0000-000000000002)")
+
+	if err := b.decode(batchContentType, failedChangeSetResponse); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+
+	for name, op := range map[string]*BatchOperation{"first": first, "second": second} {
+		var odataErr *ODataError
+		if !errors.As(op.Err, &odataErr) || op.StatusCode != http.StatusBadRequest || odataErr.Code != "0x80048d19" {
+			t.Errorf("%s = %d, %v, want the change set error", name, op.StatusCode, op.Err)
+		}
+	}
+
+	// The response stopped after the failed change set
+	for name, op := range map[string]*BatchOperation{"after": after, "last": last} {
+		if !errors.Is(op.Err, ErrNotExecuted) {
+			t.Errorf("%s Err = %v, want ErrNotExecuted", name, op.Err)
+		}
+	}
+}
+
+// changeSetResponse answers a change set of two creates, in the opposite order of the requests
+var changeSetResponse = crlf(`--batchresponse_5f4e4b2a-9d1c-4c59-8d3b-1d2f0f3b6a11
+Content-Type: multipart/mixed; boundary=changesetresponse_8a2d0c6e-3f4b-4e1a-9c7d-2b5e6f7a8b90
+
+--changesetresponse_8a2d0c6e-3f4b-4e1a-9c7d-2b5e6f7a8b90
+Content-Type: application/http
+Content-Transfer-Encoding: binary
+Content-ID: 2
+
+HTTP/1.1 204 No Content
+OData-Version: 4.0
+OData-EntityId: https://org.crm4.dynamics.com/api/data/v9.2/contacts(bbbbbbbb-1a2b-ef11-8ee8-000d3ab8c4f1)
+
+
+--changesetresponse_8a2d0c6e-3f4b-4e1a-9c7d-2b5e6f7a8b90
+Content-Type: application/http
+Content-Transfer-Encoding: binary
+Content-ID: 1
+
+HTTP/1.1 204 No Content
+OData-Version: 4.0
+OData-EntityId: https://org.crm4.dynamics.com/api/data/v9.2/accounts(aaaaaaaa-1a2b-ef11-8ee8-000d3ab8c4f1)
+
+
+--changesetresponse_8a2d0c6e-3f4b-4e1a-9c7d-2b5e6f7a8b90--
+--batchresponse_5f4e4b2a-9d1c-4c59-8d3b-1d2f0f3b6a11--
+`)
+
+func TestDecodeChangeSetByContentID(t *testing.T) {
+	b := NewBatch()
+	cs := b.ChangeSet()
+	account := cs.Post("accounts", map[string]interface{}{"name": "Kund AB"})
+	contact := cs.Post("contacts", map[string]interface{}{"lastname": "Svensson"})
+
+	if err := b.decode(batchContentType, changeSetResponse); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+
+	if id := account.EntityID(); account.Err != nil || id != "aaaaaaaa-1a2b-ef11-8ee8-000d3ab8c4f1" {
+		t.Errorf("account = %q, %v", id, account.Err)
+	}
+	if id := contact.EntityID(); contact.Err != nil || id != "bbbbbbbb-1a2b-ef11-8ee8-000d3ab8c4f1" {
+		t.Errorf("contact = %q, %v", id, contact.Err)
+	}
+}
+
+func TestDecodeMoreParts(t *testing.T) {
+	b := NewBatch()
+	b.Get("WhoAmI")
+	if err := b.decode(batchContentType, continueOnErrorResponse); err == nil {
+		t.Error("decode = nil, want an error for a response with more parts than requests")
+	}
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	const baseURL = "https://org.crm4.dynamics.com/api/data/v9.2/"
+
+	b := NewBatch()
+	b.Get("accounts?$select=name")
+	cs := b.ChangeSet()
+	account := cs.Post("accounts", map[string]interface{}{"name": "Kund AB"})
+	cs.Post("contacts", map[string]interface{}{
+		"lastname": "Svensson",
+		BindAnnotation("parentcustomerid_account"): account.Reference(),
+	})
+	b.Delete("contacts(cccccccc-1a2b-ef11-8ee8-000d3ab8c4f1)")
+
+	body, boundary, err := b.encode(baseURL)
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	type request struct {
+		method, url, contentID string
+		body                   map[string]interface{}
+	}
+	var got []request
+	readRequest := func(part *multipart.Part) {
+		req, err := http.ReadRequest(bufio.NewReader(part))
+		if err != nil {
+			t.Fatalf("ReadRequest: %v", err)
+		}
+		r := request{method: req.Method, url: req.RequestURI, contentID: part.Header.Get("Content-ID")}
+		if data, _ := io.ReadAll(req.Body); len(data) > 0 {
+			if err := json.Unmarshal(data, &r.body); err != nil {
+				t.Fatalf("request body %q: %v", data, err)
+			}
+		}
+		got = append(got, r)
+	}
+
+	r := multipart.NewReader(bytes.NewReader(body), boundary)
+	for {
+		part, err := r.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("NextPart: %v", err)
+		}
+
+		mediaType, params, err := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		if err != nil {
+			t.Fatalf("part content type: %v", err)
+		}
+		if mediaType != "multipart/mixed" {
+			readRequest(part)
+			continue
+		}
+		cr := multipart.NewReader(part, params["boundary"])
+		for {
+			opPart, err := cr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("change set NextPart: %v", err)
+			}
+			readRequest(opPart)
+		}
+	}
+
+	want := []request{
+		{method: "GET", url: baseURL + "accounts?$select=name"},
+		{method: "POST", url: baseURL + "accounts", contentID: "2", body: map[string]interface{}{"name": "Kund AB"}},
+		{method: "POST", url: baseURL + "contacts", contentID: "3", body: map[string]interface{}{"lastname": "Svensson", "parentcustomerid_account@odata.bind": "$2"}},
+		{method: "DELETE", url: baseURL + "contacts(cccccccc-1a2b-ef11-8ee8-000d3ab8c4f1)"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("encoded %d requests, want %d: %+v", len(got), len(want), got)
+	}
+	for i := range want {
+		g, w := got[i], want[i]
+		if g.method != w.method || g.url != w.url || g.contentID != w.contentID || !equalJSON(g.body, w.body) {
+			t.Errorf("request %d = %+v, want %+v", i, g, w)
+		}
+	}
+}
+
+func equalJSON(a, b map[string]interface{}) bool {
+	x, _ := json.Marshal(a)
+	y, _ := json.Marshal(b)
+	return bytes.Equal(x, y)
+}
@@ -0,0 +1,43 @@
+package dynamics
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// EntityReference returns the reference to a record used as the value of an @odata.bind annotation
+func EntityReference(entitySet, id string) string {
+	return fmt.Sprintf("/%s(%s)", entitySet, id)
+}
+
+// BindAnnotation returns the property name that binds the given single-valued navigation property
+func BindAnnotation(navigationProperty string) string {
+	return navigationProperty + "@odata.bind"
+}
+
+// Bind sets the lookup behind navigationProperty to the record with the given ID in entitySet.
+// The lookup is set in the same request that creates or updates the invoice.
+func (i *DynamicsInvoice) Bind(navigationProperty, entitySet, id string) {
+	if i.Bindings == nil {
+		i.Bindings = make(map[string]string)
+	}
+	i.Bindings[navigationProperty] = EntityReference(entitySet, id)
+}
+
+// MarshalJSON encodes the invoice columns followed by an @odata.bind annotation per binding
+func (i DynamicsInvoice) MarshalJSON() ([]byte, error) {
+	type columns DynamicsInvoice
+	data, err := json.Marshal(columns(i))
+	if err != nil || len(i.Bindings) == 0 {
+		return data, err
+	}
+
+	var body map[string]interface{}
+	if err := json.Unmarshal(data, &body); err != nil {
+		return nil, err
+	}
+	for navigationProperty, reference := range i.Bindings {
+		body[BindAnnotation(navigationProperty)] = reference
+	}
+	return json.Marshal(body)
+}
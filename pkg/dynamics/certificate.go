@@ -0,0 +1,152 @@
+package dynamics
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// ClientCertificate is an app registration certificate used to sign client assertions
+type ClientCertificate struct {
+	Certificate *x509.Certificate
+	PrivateKey  *rsa.PrivateKey
+}
+
+// LoadClientCertificate loads a certificate and its RSA private key.
+// certFile is either a PFX/PKCS#12 file (.pfx or .p12), decrypted with password,
+// or a PEM file. For PEM the key may be in the same file or in a separate keyFile.
+func LoadClientCertificate(certFile, keyFile, password string) (*ClientCertificate, error) {
+	data, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading certificate file: %v", err)
+	}
+
+	lower := strings.ToLower(certFile)
+	if strings.HasSuffix(lower, ".pfx") || strings.HasSuffix(lower, ".p12") {
+		// Exports from Azure Key Vault and the Windows certificate store include the CA chain,
+		// which is not needed to sign client assertions
+		key, cert, _, err := pkcs12.DecodeChain(data, password)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding PFX certificate: %v", err)
+		}
+		rsaKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("certificate key must be an RSA key, got %T", key)
+		}
+		return &ClientCertificate{Certificate: cert, PrivateKey: rsaKey}, nil
+	}
+
+	if keyFile != "" {
+		keyData, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading certificate key file: %v", err)
+		}
+		data = append(append(data, '\n'), keyData...)
+	}
+	return parsePEMCertificate(data)
+}
+
+// parsePEMCertificate finds the first certificate and private key among the PEM blocks in data
+func parsePEMCertificate(data []byte) (*ClientCertificate, error) {
+	cc := &ClientCertificate{}
+
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		switch block.Type {
+		case "CERTIFICATE":
+			if cc.Certificate != nil {
+				continue
+			}
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing certificate: %v", err)
+			}
+			cc.Certificate = cert
+		case "RSA PRIVATE KEY":
+			key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing private key: %v", err)
+			}
+			cc.PrivateKey = key
+		case "PRIVATE KEY":
+			key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing private key: %v", err)
+			}
+			rsaKey, ok := key.(*rsa.PrivateKey)
+			if !ok {
+				return nil, fmt.Errorf("certificate key must be an RSA key, got %T", key)
+			}
+			cc.PrivateKey = rsaKey
+		}
+	}
+
+	if cc.Certificate == nil {
+		return nil, fmt.Errorf("no certificate found in PEM data")
+	}
+	if cc.PrivateKey == nil {
+		return nil, fmt.Errorf("no private key found in PEM data")
+	}
+	return cc, nil
+}
+
+// Assertion returns a signed JWT client assertion for the given client ID,
+// addressed to the token endpoint it will be sent to
+func (cc *ClientCertificate) Assertion(clientID, tokenEndpoint string) (string, error) {
+	thumbprint := sha1.Sum(cc.Certificate.Raw)
+	header := map[string]string{
+		"alg": "RS256",
+		"typ": "JWT",
+		"x5t": base64.RawURLEncoding.EncodeToString(thumbprint[:]),
+	}
+
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	claims := map[string]interface{}{
+		"aud": tokenEndpoint,
+		"iss": clientID,
+		"sub": clientID,
+		"jti": fmt.Sprintf("%x", jti),
+		"nbf": now.Unix(),
+		"iat": now.Unix(),
+		"exp": now.Add(10 * time.Minute).Unix(),
+	}
+
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(claimsJSON)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, cc.PrivateKey, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("error signing client assertion: %v", err)
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
@@ -0,0 +1,82 @@
+package dynamics
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// newCertificate creates a certificate for a new RSA key, signed by parent or self-signed
+func newCertificate(t *testing.T, name string, isCA bool, parent *x509.Certificate, parentKey *rsa.PrivateKey) (*x509.Certificate, *rsa.PrivateKey) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestLoadClientCertificatePFX(t *testing.T) {
+	ca, caKey := newCertificate(t, "Test CA", true, nil, nil)
+	leaf, leafKey := newCertificate(t, "fortnox-sync", false, ca, caKey)
+
+	tests := []struct {
+		name    string
+		caCerts []*x509.Certificate
+	}{
+		{"without chain", nil},
+		{"with chain", []*x509.Certificate{ca}},
+	}
+
+	for _, tt := range tests {
+		pfx, err := pkcs12.Modern.Encode(leafKey, leaf, tt.caCerts, "secret")
+		if err != nil {
+			t.Fatalf("%s: Encode: %v", tt.name, err)
+		}
+		path := filepath.Join(t.TempDir(), "client.pfx")
+		if err := os.WriteFile(path, pfx, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		cc, err := LoadClientCertificate(path, "", "secret")
+		if err != nil {
+			t.Fatalf("%s: LoadClientCertificate: %v", tt.name, err)
+		}
+		if !cc.Certificate.Equal(leaf) || !cc.PrivateKey.Equal(leafKey) {
+			t.Errorf("%s: loaded %s, want the client certificate and its key", tt.name, cc.Certificate.Subject.CommonName)
+		}
+
+		if _, err := LoadClientCertificate(path, "", "wrong"); err == nil {
+			t.Errorf("%s: LoadClientCertificate with the wrong password = nil, want an error", tt.name)
+		}
+	}
+}
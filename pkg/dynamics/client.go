@@ -1,108 +1,267 @@
 package dynamics
 
 import (
-    "fmt"
-    "github.com/go-resty/resty/v2"
-    "time"
-    "os"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+
+	"fortnox_dynamics_integration/pkg/retry"
+)
+
+const (
+	// tokenExpiryMargin is subtracted from the token lifetime so that a token is
+	// refreshed before it expires rather than while a request is in flight
+	tokenExpiryMargin = 2 * time.Minute
+
+	// defaultRequestTimeout bounds a single HTTP round trip to Dynamics 365
+	defaultRequestTimeout = 60 * time.Second
 )
 
 // D365 represents the Dynamics 365 client
 type D365 struct {
-    Resty        *resty.Client
-    URL          string
-    TenantID     string
-    ClientID     string
-    ClientSecret string
-    AccessToken  string
-    ExpiresAt    time.Time
+	Resty        *resty.Client
+	URL          string
+	TenantID     string
+	ClientID     string
+	ClientSecret string
+	AccessToken  string
+	ExpiresAt    time.Time
+
+	// RequestTimeout bounds each HTTP request, including token requests
+	RequestTimeout time.Duration
+
+	// RetryPolicy decides how throttled and failed requests are retried
+	RetryPolicy retry.Policy
+
+	// Authentication options, see auth.go
+	AuthorityHost       string
+	AuthEndpoint        string
+	AuthMethod          string
+	CertificateFile     string
+	CertificateKeyFile  string
+	CertificatePassword string
+	certificate         *ClientCertificate
+
+	// mu guards AccessToken and ExpiresAt so that concurrent workers share a single refresh
+	mu sync.Mutex
 }
 
 // NewD365Client initializes a new Dynamics 365 client
 func NewD365Client() *D365 {
-    client := resty.New()
-    return &D365{
-        Resty:        client,
-        URL:          os.Getenv("DYNAMICS_API_BASE_URL"),
-        TenantID:     os.Getenv("DYNAMICS_TENANT_ID"),
-        ClientID:     os.Getenv("DYNAMICS_CLIENT_ID"),
-        ClientSecret: os.Getenv("DYNAMICS_CLIENT_SECRET"),
-    }
+	client := resty.New()
+	d := &D365{
+		Resty:        client,
+		URL:          os.Getenv("DYNAMICS_API_BASE_URL"),
+		TenantID:     os.Getenv("DYNAMICS_TENANT_ID"),
+		ClientID:     os.Getenv("DYNAMICS_CLIENT_ID"),
+		ClientSecret: os.Getenv("DYNAMICS_CLIENT_SECRET"),
+
+		AuthorityHost:       os.Getenv("DYNAMICS_AUTHORITY_HOST"),
+		AuthEndpoint:        os.Getenv("DYNAMICS_AUTH_ENDPOINT"),
+		AuthMethod:          os.Getenv("DYNAMICS_AUTH_METHOD"),
+		CertificateFile:     os.Getenv("DYNAMICS_CERT_FILE"),
+		CertificateKeyFile:  os.Getenv("DYNAMICS_CERT_KEY_FILE"),
+		CertificatePassword: os.Getenv("DYNAMICS_CERT_PASSWORD"),
+
+		RetryPolicy: retry.DefaultPolicy(),
+	}
+
+	// An invalid value leaves the default timeout in place; commands check it before creating the client
+	if timeout, err := time.ParseDuration(os.Getenv("DYNAMICS_REQUEST_TIMEOUT")); err == nil {
+		d.RequestTimeout = timeout
+	}
+
+	return d
 }
 
 // CheckAndRefreshToken checks if the access token is expired and refreshes it if necessary
 func (d *D365) CheckAndRefreshToken() error {
-    if time.Now().After(d.ExpiresAt) {
-        return d.AuthenticateApi()
-    }
-    return nil
+	return d.CheckAndRefreshTokenContext(context.Background())
+}
+
+// CheckAndRefreshTokenContext is like CheckAndRefreshToken but carries a context
+func (d *D365) CheckAndRefreshTokenContext(ctx context.Context) error {
+	_, err := d.validToken(ctx)
+	return err
+}
+
+// validToken returns an access token that has not expired, authenticating first if needed
+func (d *D365) validToken(ctx context.Context) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.AccessToken == "" || time.Now().After(d.ExpiresAt) {
+		if err := d.authenticate(ctx); err != nil {
+			return "", err
+		}
+	}
+	return d.AccessToken, nil
+}
+
+// renewRejectedToken authenticates again after Dynamics rejected the given token.
+// If another worker has already replaced the token, the new one is reused.
+func (d *D365) renewRejectedToken(ctx context.Context, rejected string) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.AccessToken == rejected {
+		if err := d.authenticate(ctx); err != nil {
+			return "", err
+		}
+	}
+	return d.AccessToken, nil
+}
+
+// do sends an authenticated request built by prepare to the given Web API endpoint.
+// If Dynamics answers 401 because the token was revoked before its expiry time,
+// the token is renewed and the request is sent once more.
+func (d *D365) do(ctx context.Context, method, endpoint string, prepare func(*resty.Request) *resty.Request) (*resty.Response, error) {
+	token, err := d.validToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := d.send(ctx, token, method, endpoint, prepare)
+	if err != nil || resp.StatusCode() != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	token, err = d.renewRejectedToken(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.send(ctx, token, method, endpoint, prepare)
+}
+
+// send performs a request with the given token, retrying throttled and failed
+// attempts according to RetryPolicy. Each attempt is bounded by RequestTimeout.
+func (d *D365) send(ctx context.Context, token, method, endpoint string, prepare func(*resty.Request) *resty.Request) (*resty.Response, error) {
+	var resp *resty.Response
+
+	err := d.RetryPolicy.Do(ctx, method != resty.MethodPost, func(ctx context.Context) (int, http.Header, error) {
+		ctx, cancel := context.WithTimeout(ctx, d.requestTimeout())
+		defer cancel()
+
+		var err error
+		resp, err = prepare(d.Resty.R()).
+			SetContext(ctx).
+			SetHeader("Authorization", fmt.Sprintf("Bearer %v", token)).
+			Execute(method, d.URL+"/api/data/v9.2/"+endpoint)
+		if err != nil {
+			return 0, nil, err
+		}
+		return resp.StatusCode(), resp.Header(), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+func (d *D365) requestTimeout() time.Duration {
+	if d.RequestTimeout <= 0 {
+		return defaultRequestTimeout
+	}
+	return d.RequestTimeout
 }
 
 // GetRequest makes an authenticated HTTP GET request to the specified endpoint
 func (d *D365) GetRequest(endpoint string) ([]byte, error) {
-    if err := d.CheckAndRefreshToken(); err != nil {
-        return nil, err
-    }
+	return d.GetRequestContext(context.Background(), endpoint)
+}
 
-    resp, err := d.Resty.R().
-        SetHeader("Authorization", fmt.Sprintf("Bearer %v", d.AccessToken)).
-        Get(d.URL + "/api/data/v9.2/" + endpoint)
+// GetRequestContext is like GetRequest but carries a context
+func (d *D365) GetRequestContext(ctx context.Context, endpoint string) ([]byte, error) {
+	resp, err := d.do(ctx, resty.MethodGet, endpoint, func(r *resty.Request) *resty.Request {
+		return r
+	})
 
-    if err != nil {
-        return nil, err
-    }
+	if err != nil {
+		return nil, err
+	}
 
-    if resp.StatusCode() != 200 {
-        return nil, fmt.Errorf("error making GET request: %v", resp.String())
-    }
+	if resp.StatusCode() != 200 {
+		return nil, newODataError(resp.StatusCode(), resp.Body())
+	}
 
-    return resp.Body(), nil
+	return resp.Body(), nil
 }
 
 // PostRequest makes an authenticated HTTP POST request to the specified endpoint with the given request body
 func (d *D365) PostRequest(endpoint string, values interface{}) ([]byte, error) {
-    if err := d.CheckAndRefreshToken(); err != nil {
-        return nil, err
-    }
+	return d.PostRequestContext(context.Background(), endpoint, values)
+}
 
-    resp, err := d.Resty.R().
-        SetHeader("Content-Type", "application/json; charset=utf-8").
-        SetHeader("Authorization", fmt.Sprintf("Bearer %v", d.AccessToken)).
-        SetHeader("Prefer", "return=representation").
-        SetBody(values).
-        Post(d.URL + "/api/data/v9.2/" + endpoint)
+// PostRequestContext is like PostRequest but carries a context
+func (d *D365) PostRequestContext(ctx context.Context, endpoint string, values interface{}) ([]byte, error) {
+	resp, err := d.do(ctx, resty.MethodPost, endpoint, func(r *resty.Request) *resty.Request {
+		return r.
+			SetHeader("Content-Type", "application/json; charset=utf-8").
+			SetHeader("Prefer", "return=representation").
+			SetBody(values)
+	})
 
-    if err != nil {
-        return nil, err
-    }
+	if err != nil {
+		return nil, err
+	}
 
-    if resp.StatusCode() != 200 && resp.StatusCode() != 201 {
-        return nil, fmt.Errorf("error making POST request: %v", resp.String())
-    }
+	if resp.StatusCode() != 200 && resp.StatusCode() != 201 {
+		return nil, newODataError(resp.StatusCode(), resp.Body())
+	}
 
-    return resp.Body(), nil
+	return resp.Body(), nil
 }
 
 // PatchRequest makes an authenticated HTTP PATCH request to the specified endpoint with the given request body
 func (d *D365) PatchRequest(endpoint string, values interface{}) ([]byte, error) {
-    if err := d.CheckAndRefreshToken(); err != nil {
-        return nil, err
-    }
-
-    resp, err := d.Resty.R().
-        SetHeader("Content-Type", "application/json; charset=utf-8").
-        SetHeader("Authorization", fmt.Sprintf("Bearer %v", d.AccessToken)).
-        SetHeader("Prefer", "return=representation").
-        SetBody(values).
-        Patch(d.URL + "/api/data/v9.2/" + endpoint)
-
-    if err != nil {
-        return nil, err
-    }
-
-    if resp.StatusCode() != 200 && resp.StatusCode() != 204 {
-        return nil, fmt.Errorf("error making PATCH request: %v", resp.String())
-    }
-
-    return resp.Body(), nil
+	return d.PatchRequestContext(context.Background(), endpoint, values)
+}
+
+// PatchRequestContext is like PatchRequest but carries a context
+func (d *D365) PatchRequestContext(ctx context.Context, endpoint string, values interface{}) ([]byte, error) {
+	resp, err := d.do(ctx, resty.MethodPatch, endpoint, func(r *resty.Request) *resty.Request {
+		return r.
+			SetHeader("Content-Type", "application/json; charset=utf-8").
+			SetHeader("Prefer", "return=representation").
+			SetBody(values)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode() != 200 && resp.StatusCode() != 204 {
+		return nil, newODataError(resp.StatusCode(), resp.Body())
+	}
+
+	return resp.Body(), nil
+}
+
+// DeleteRequest makes an authenticated HTTP DELETE request to the specified endpoint
+func (d *D365) DeleteRequest(endpoint string) error {
+	return d.DeleteRequestContext(context.Background(), endpoint)
+}
+
+// DeleteRequestContext is like DeleteRequest but carries a context
+func (d *D365) DeleteRequestContext(ctx context.Context, endpoint string) error {
+	resp, err := d.do(ctx, resty.MethodDelete, endpoint, func(r *resty.Request) *resty.Request {
+		return r
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode() != 200 && resp.StatusCode() != 204 {
+		return newODataError(resp.StatusCode(), resp.Body())
+	}
+
+	return nil
 }
@@ -1,13 +1,58 @@
 package dynamics
 
 import (
+	"context"
 	"fmt"
-	"net/url"
 )
 
 // SearchCustomer searches for a customer in Dynamics 365 based on customer number
+//
+// Deprecated: use FindAccountByCustomerNumber, which returns a typed Account.
 func (d *D365) SearchCustomer(customerNumber string) ([]byte, error) {
-	filter := url.QueryEscape(fmt.Sprintf("new_kundnummer eq '%s'", customerNumber))
-	query := fmt.Sprintf("accounts?$filter=%s&$top=1", filter)
-	return d.GetRequest(query)
+	return d.SearchCustomerContext(context.Background(), customerNumber)
+}
+
+// SearchCustomerContext is like SearchCustomer but carries a context
+//
+// Deprecated: use FindAccountByCustomerNumberContext.
+func (d *D365) SearchCustomerContext(ctx context.Context, customerNumber string) ([]byte, error) {
+	query := NewQuery("accounts").Filter(Eq("new_kundnummer", customerNumber)).Top(1)
+	return d.GetRequestContext(ctx, query.String())
+}
+
+// FindAccountByCustomerNumber returns the account with the given Fortnox customer number,
+// or nil if there is none
+func (d *D365) FindAccountByCustomerNumber(customerNumber string) (*Account, error) {
+	return d.FindAccountByCustomerNumberContext(context.Background(), customerNumber)
+}
+
+// FindAccountByCustomerNumberContext is like FindAccountByCustomerNumber but carries a context
+func (d *D365) FindAccountByCustomerNumberContext(ctx context.Context, customerNumber string) (*Account, error) {
+	query := NewQuery("accounts").
+		Filter(Eq("new_kundnummer", customerNumber)).
+		Select(accountColumns...).
+		Top(1)
+	response, err := d.GetRequestContext(ctx, query.String())
+	if err != nil {
+		return nil, err
+	}
+	return first[Account](response)
+}
+
+// FindContactsByAccount returns the contacts that belong to an account
+func (d *D365) FindContactsByAccount(accountID string) ([]Contact, error) {
+	return d.FindContactsByAccountContext(context.Background(), accountID)
+}
+
+// FindContactsByAccountContext is like FindContactsByAccount but carries a context
+func (d *D365) FindContactsByAccountContext(ctx context.Context, accountID string) ([]Contact, error) {
+	query := NewQuery("contacts").
+		Filter(Eq("_parentcustomerid_value", GUID(accountID))).
+		Select(contactColumns...).
+		OrderBy("fullname")
+	contacts, err := Collect[Contact](d.QueryContext(ctx, query))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch contacts: %w", err)
+	}
+	return contacts, nil
 }
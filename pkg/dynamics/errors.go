@@ -0,0 +1,62 @@
+package dynamics
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// ODataError is returned when the Dynamics 365 Web API answers with an error status.
+// Use errors.As to inspect it.
+type ODataError struct {
+	StatusCode int
+	Code       string // error.code, for example 0x80040217 when a record does not exist
+	Message    string // error.message
+	Body       string // Raw response body, for errors without an OData error object
+}
+
+func (e *ODataError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("dynamics: status %d, code %s: %s", e.StatusCode, e.Code, e.Message)
+	}
+	return fmt.Sprintf("dynamics: status %d: %s", e.StatusCode, e.Body)
+}
+
+// NotFound reports whether the requested record or entity set does not exist
+func (e *ODataError) NotFound() bool {
+	return e.StatusCode == http.StatusNotFound
+}
+
+// PreconditionFailed reports whether an If-Match or If-None-Match condition was not met,
+// for example when a create-only upsert finds an existing record
+func (e *ODataError) PreconditionFailed() bool {
+	return e.StatusCode == http.StatusPreconditionFailed
+}
+
+// RateLimited reports whether the request was rejected by the service protection limits
+func (e *ODataError) RateLimited() bool {
+	return e.StatusCode == http.StatusTooManyRequests
+}
+
+// Temporary reports whether the same request may succeed if sent again later
+func (e *ODataError) Temporary() bool {
+	return e.RateLimited() || e.StatusCode >= http.StatusInternalServerError
+}
+
+// newODataError builds an ODataError from an error response, reading the OData error object if present
+func newODataError(statusCode int, body []byte) *ODataError {
+	odataErr := &ODataError{StatusCode: statusCode, Body: string(body)}
+
+	var errorResponse struct {
+		Error struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(body, &errorResponse) == nil {
+		odataErr.Code = errorResponse.Error.Code
+		odataErr.Message = errorResponse.Error.Message
+	}
+
+	return odataErr
+}
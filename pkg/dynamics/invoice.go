@@ -1,16 +1,21 @@
 package dynamics
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"net/url"
 )
 
 // CreateInvoice creates a new invoice in Dynamics 365
 func (d *D365) CreateInvoice(invoice DynamicsInvoice) (string, error) {
-	response, err := d.PostRequest("new_fakturas", invoice)
+	return d.CreateInvoiceContext(context.Background(), invoice)
+}
+
+// CreateInvoiceContext is like CreateInvoice but carries a context
+func (d *D365) CreateInvoiceContext(ctx context.Context, invoice DynamicsInvoice) (string, error) {
+	response, err := d.PostRequestContext(ctx, "new_fakturas", invoice)
 	if err != nil {
-		return "", fmt.Errorf("failed to create invoice: %v", err)
+		return "", fmt.Errorf("failed to create invoice: %w", err)
 	}
 
 	var createdInvoice struct {
@@ -23,27 +28,115 @@ func (d *D365) CreateInvoice(invoice DynamicsInvoice) (string, error) {
 	return createdInvoice.ID, nil
 }
 
+// AssociateCustomer links an existing invoice to a customer account in Dynamics 365.
+// New invoices bind the customer with DynamicsInvoice.Bind instead, saving a request.
+func (d *D365) AssociateCustomer(invoiceID, customerID string) error {
+	return d.AssociateCustomerContext(context.Background(), invoiceID, customerID)
+}
+
+// AssociateCustomerContext is like AssociateCustomer but carries a context
+func (d *D365) AssociateCustomerContext(ctx context.Context, invoiceID, customerID string) error {
+	associateBody := map[string]string{
+		"@odata.id": fmt.Sprintf("%s/api/data/v9.2/accounts(%s)", d.URL, customerID),
+	}
+	_, err := d.PostRequestContext(ctx, fmt.Sprintf("new_fakturas(%s)/new_customer_account/$ref", invoiceID), associateBody)
+	if err != nil {
+		return fmt.Errorf("failed to associate invoice with customer: %w", err)
+	}
+	return nil
+}
+
 // SearchInvoice searches for an invoice in Dynamics 365 based on document number
 func (d *D365) SearchInvoice(documentNumber string) (string, error) {
-	filter := url.QueryEscape(fmt.Sprintf("new_documentnumber eq '%s'", documentNumber))
-	query := fmt.Sprintf("new_fakturas?$filter=%s&$top=1", filter)
-	response, err := d.GetRequest(query)
-	if err != nil {
+	return d.SearchInvoiceContext(context.Background(), documentNumber)
+}
+
+// SearchInvoiceContext is like SearchInvoice but carries a context
+func (d *D365) SearchInvoiceContext(ctx context.Context, documentNumber string) (string, error) {
+	faktura, err := d.FindFakturaByDocumentNumberContext(ctx, documentNumber)
+	if err != nil || faktura == nil {
 		return "", err
 	}
+	return faktura.ID, nil
+}
+
+// FindFakturaByDocumentNumber returns the invoice record with the given Fortnox document number,
+// or nil if there is none
+func (d *D365) FindFakturaByDocumentNumber(documentNumber string) (*Faktura, error) {
+	return d.FindFakturaByDocumentNumberContext(context.Background(), documentNumber)
+}
 
-	var invoices struct {
-		Value []struct {
-			InvoiceID string `json:"new_fakturaid"`
-		} `json:"value"`
+// FindFakturaByDocumentNumberContext is like FindFakturaByDocumentNumber but carries a context
+func (d *D365) FindFakturaByDocumentNumberContext(ctx context.Context, documentNumber string) (*Faktura, error) {
+	query := NewQuery("new_fakturas").
+		Filter(Eq("new_documentnumber", documentNumber)).
+		Select(fakturaColumns...).
+		Top(1)
+	response, err := d.GetRequestContext(ctx, query.String())
+	if err != nil {
+		return nil, err
 	}
-	if err := json.Unmarshal(response, &invoices); err != nil {
-		return "", fmt.Errorf("failed to unmarshal search invoice response: %v", err)
+	return first[Faktura](response)
+}
+
+// GetFaktura fetches an invoice record from Dynamics 365 by its ID
+func (d *D365) GetFaktura(invoiceID string) (*Faktura, error) {
+	return d.GetFakturaContext(context.Background(), invoiceID)
+}
+
+// GetFakturaContext is like GetFaktura but carries a context
+func (d *D365) GetFakturaContext(ctx context.Context, invoiceID string) (*Faktura, error) {
+	query := NewQuery(fmt.Sprintf("new_fakturas(%s)", invoiceID)).Select(fakturaColumns...)
+	response, err := d.GetRequestContext(ctx, query.String())
+	if err != nil {
+		return nil, err
+	}
+
+	var faktura Faktura
+	if err := json.Unmarshal(response, &faktura); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal invoice response: %v", err)
 	}
+	return &faktura, nil
+}
+
+// GetInvoice fetches an existing invoice from Dynamics 365 by its ID
+func (d *D365) GetInvoice(invoiceID string) (DynamicsInvoice, error) {
+	return d.GetInvoiceContext(context.Background(), invoiceID)
+}
 
-	if len(invoices.Value) > 0 {
-		return invoices.Value[0].InvoiceID, nil
+// GetInvoiceContext is like GetInvoice but carries a context
+func (d *D365) GetInvoiceContext(ctx context.Context, invoiceID string) (DynamicsInvoice, error) {
+	faktura, err := d.GetFakturaContext(ctx, invoiceID)
+	if err != nil {
+		return DynamicsInvoice{}, err
 	}
+	return faktura.Invoice(), nil
+}
+
+// UpdateInvoice updates the given columns of an existing invoice in Dynamics 365
+func (d *D365) UpdateInvoice(invoiceID string, changes map[string]interface{}) error {
+	return d.UpdateInvoiceContext(context.Background(), invoiceID, changes)
+}
 
-	return "", nil
-}
\ No newline at end of file
+// UpdateInvoiceContext is like UpdateInvoice but carries a context
+func (d *D365) UpdateInvoiceContext(ctx context.Context, invoiceID string, changes map[string]interface{}) error {
+	_, err := d.PatchRequestContext(ctx, fmt.Sprintf("new_fakturas(%s)", invoiceID), changes)
+	if err != nil {
+		return fmt.Errorf("failed to update invoice: %w", err)
+	}
+	return nil
+}
+
+// DeleteInvoice deletes an invoice from Dynamics 365
+func (d *D365) DeleteInvoice(invoiceID string) error {
+	return d.DeleteInvoiceContext(context.Background(), invoiceID)
+}
+
+// DeleteInvoiceContext is like DeleteInvoice but carries a context
+func (d *D365) DeleteInvoiceContext(ctx context.Context, invoiceID string) error {
+	err := d.DeleteRequestContext(ctx, fmt.Sprintf("new_fakturas(%s)", invoiceID))
+	if err != nil {
+		return fmt.Errorf("failed to delete invoice: %w", err)
+	}
+	return nil
+}
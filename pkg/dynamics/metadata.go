@@ -0,0 +1,329 @@
+package dynamics
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"strings"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// Metadata is the schema of the Web API, parsed from the CSDL $metadata document
+type Metadata struct {
+	entityTypes map[string]*EntityType // Keyed by name without namespace, for example new_faktura
+	entitySets  map[string]string      // Entity type name keyed by entity set name
+}
+
+// EntityType describes a table: its columns, lookups and keys
+type EntityType struct {
+	Name                 string // Logical name, for example new_faktura
+	BaseType             string
+	Key                  []string
+	Properties           []Property
+	NavigationProperties []NavigationProperty
+	AlternateKeys        [][]string // Columns of each alternate key
+
+	metadata *Metadata
+}
+
+// Property is a column of an entity type
+type Property struct {
+	Name string
+	Type string // EDM type, for example Edm.String or Edm.Decimal
+}
+
+// NavigationProperty is a relationship from an entity type, used with @odata.bind and $expand
+type NavigationProperty struct {
+	Name string
+	Type string // For example mscrm.account, or Collection(mscrm.contact) for a one-to-many relationship
+}
+
+// Collection reports whether the relationship leads to many records
+func (n NavigationProperty) Collection() bool {
+	return strings.HasPrefix(n.Type, "Collection(")
+}
+
+// Target returns the name of the related entity type, without namespace
+func (n NavigationProperty) Target() string {
+	name := strings.TrimSuffix(strings.TrimPrefix(n.Type, "Collection("), ")")
+	return unqualified(name)
+}
+
+// csdl mirrors the parts of the CSDL document that are read. Elements are matched by local name.
+type csdl struct {
+	Schemas []struct {
+		EntityTypes []struct {
+			Name     string `xml:"Name,attr"`
+			BaseType string `xml:"BaseType,attr"`
+			Key      struct {
+				PropertyRefs []struct {
+					Name string `xml:"Name,attr"`
+				} `xml:"PropertyRef"`
+			} `xml:"Key"`
+			Properties []struct {
+				Name string `xml:"Name,attr"`
+				Type string `xml:"Type,attr"`
+			} `xml:"Property"`
+			NavigationProperties []struct {
+				Name string `xml:"Name,attr"`
+				Type string `xml:"Type,attr"`
+			} `xml:"NavigationProperty"`
+			Annotations []csdlAnnotation `xml:"Annotation"`
+		} `xml:"EntityType"`
+		EntityContainers []struct {
+			EntitySets []struct {
+				Name       string `xml:"Name,attr"`
+				EntityType string `xml:"EntityType,attr"`
+			} `xml:"EntitySet"`
+		} `xml:"EntityContainer"`
+	} `xml:"DataServices>Schema"`
+}
+
+// csdlAnnotation holds the alternate keys of an entity type:
+//
+//	<Annotation Term="OData.Community.Keys.V1.AlternateKeys">
+//	  <Collection><Record>
+//	    <PropertyValue Property="Key"><Collection><Record>
+//	      <PropertyValue Property="Name" PropertyPath="new_documentnumber"/>
+//	    </Record></Collection></PropertyValue>
+//	  </Record></Collection>
+//	</Annotation>
+type csdlAnnotation struct {
+	Term    string `xml:"Term,attr"`
+	Records []struct {
+		PropertyValues []struct {
+			Property string `xml:"Property,attr"`
+			Records  []struct {
+				PropertyValues []struct {
+					Property     string `xml:"Property,attr"`
+					PropertyPath string `xml:"PropertyPath,attr"`
+				} `xml:"PropertyValue"`
+			} `xml:"Collection>Record"`
+		} `xml:"PropertyValue"`
+	} `xml:"Collection>Record"`
+}
+
+const alternateKeysTerm = "OData.Community.Keys.V1.AlternateKeys"
+
+// ParseMetadata parses a CSDL $metadata document
+func ParseMetadata(data []byte) (*Metadata, error) {
+	var doc csdl
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse metadata: %v", err)
+	}
+
+	m := &Metadata{entityTypes: make(map[string]*EntityType), entitySets: make(map[string]string)}
+	for _, schema := range doc.Schemas {
+		for _, et := range schema.EntityTypes {
+			entityType := &EntityType{Name: et.Name, BaseType: unqualified(et.BaseType), metadata: m}
+			for _, ref := range et.Key.PropertyRefs {
+				entityType.Key = append(entityType.Key, ref.Name)
+			}
+			for _, p := range et.Properties {
+				entityType.Properties = append(entityType.Properties, Property{Name: p.Name, Type: p.Type})
+			}
+			for _, n := range et.NavigationProperties {
+				entityType.NavigationProperties = append(entityType.NavigationProperties, NavigationProperty{Name: n.Name, Type: n.Type})
+			}
+			for _, a := range et.Annotations {
+				if a.Term != alternateKeysTerm {
+					continue
+				}
+				for _, key := range a.Records {
+					var columns []string
+					for _, pv := range key.PropertyValues {
+						if pv.Property != "Key" {
+							continue
+						}
+						for _, ref := range pv.Records {
+							for _, v := range ref.PropertyValues {
+								if v.Property == "Name" {
+									columns = append(columns, v.PropertyPath)
+								}
+							}
+						}
+					}
+					entityType.AlternateKeys = append(entityType.AlternateKeys, columns)
+				}
+			}
+			m.entityTypes[et.Name] = entityType
+		}
+
+		for _, container := range schema.EntityContainers {
+			for _, set := range container.EntitySets {
+				m.entitySets[set.Name] = unqualified(set.EntityType)
+			}
+		}
+	}
+
+	if len(m.entityTypes) == 0 {
+		return nil, fmt.Errorf("failed to parse metadata: no entity types found")
+	}
+	return m, nil
+}
+
+// unqualified strips the namespace or alias from a type name, so that
+// Microsoft.Dynamics.CRM.account and mscrm.account are both account
+func unqualified(name string) string {
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		return name[i+1:]
+	}
+	return name
+}
+
+// EntityType returns the entity type with the given name, or nil
+func (m *Metadata) EntityType(name string) *EntityType {
+	return m.entityTypes[unqualified(name)]
+}
+
+// EntitySet returns the entity type of the given entity set, or nil if there is no such entity set
+func (m *Metadata) EntitySet(name string) *EntityType {
+	typeName, ok := m.entitySets[name]
+	if !ok {
+		return nil
+	}
+	return m.entityTypes[typeName]
+}
+
+// EntitySetOf returns the name of the entity set holding records of the given entity type,
+// or an empty string if there is none
+func (m *Metadata) EntitySetOf(entityType string) string {
+	entityType = unqualified(entityType)
+	for set, typeName := range m.entitySets {
+		if typeName == entityType {
+			return set
+		}
+	}
+	return ""
+}
+
+// Property returns the column with the given name, including columns inherited from the
+// base type, or nil. Names are case sensitive, as in the Web API.
+func (t *EntityType) Property(name string) *Property {
+	for et := t; et != nil; et = et.base() {
+		for i := range et.Properties {
+			if et.Properties[i].Name == name {
+				return &et.Properties[i]
+			}
+		}
+	}
+	return nil
+}
+
+// NavigationProperty returns the relationship with the given name, including relationships
+// inherited from the base type, or nil
+func (t *EntityType) NavigationProperty(name string) *NavigationProperty {
+	for et := t; et != nil; et = et.base() {
+		for i := range et.NavigationProperties {
+			if et.NavigationProperties[i].Name == name {
+				return &et.NavigationProperties[i]
+			}
+		}
+	}
+	return nil
+}
+
+// HasAlternateKey reports whether the entity type has an alternate key made of exactly the given columns
+func (t *EntityType) HasAlternateKey(columns ...string) bool {
+	for _, key := range t.AlternateKeys {
+		if len(key) != len(columns) {
+			continue
+		}
+		matches := true
+		for _, column := range columns {
+			found := false
+			for _, k := range key {
+				found = found || k == column
+			}
+			matches = matches && found
+		}
+		if matches {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *EntityType) base() *EntityType {
+	if t.BaseType == "" || t.metadata == nil {
+		return nil
+	}
+	return t.metadata.entityTypes[t.BaseType]
+}
+
+// FetchMetadata downloads and parses the CSDL $metadata document of the Web API
+func (d *D365) FetchMetadata() (*Metadata, error) {
+	return d.FetchMetadataContext(context.Background())
+}
+
+// FetchMetadataContext is like FetchMetadata but carries a context
+func (d *D365) FetchMetadataContext(ctx context.Context) (*Metadata, error) {
+	resp, err := d.do(ctx, resty.MethodGet, "$metadata", func(r *resty.Request) *resty.Request {
+		return r.SetHeader("Accept", "application/xml")
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch metadata: %w", err)
+	}
+	if resp.StatusCode() != 200 {
+		return nil, fmt.Errorf("failed to fetch metadata: %w", newODataError(resp.StatusCode(), resp.Body()))
+	}
+
+	return ParseMetadata(resp.Body())
+}
+
+// Option is a value of a choice (option set) column
+type Option struct {
+	Value int
+	Label string
+}
+
+// FetchOptionSets returns the options of every choice column of an entity type, keyed by
+// column name. Choices are not part of $metadata and are read from the entity definitions.
+func (d *D365) FetchOptionSets(entityType string) (map[string][]Option, error) {
+	return d.FetchOptionSetsContext(context.Background(), entityType)
+}
+
+// FetchOptionSetsContext is like FetchOptionSets but carries a context
+func (d *D365) FetchOptionSetsContext(ctx context.Context, entityType string) (map[string][]Option, error) {
+	endpoint := fmt.Sprintf("EntityDefinitions(LogicalName=%s)/Attributes/Microsoft.Dynamics.CRM.PicklistAttributeMetadata", literal(entityType))
+	query := NewQuery(endpoint).Select("LogicalName").Expand("OptionSet", "Options")
+	response, err := d.GetRequestContext(ctx, query.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch option sets for %s: %w", entityType, err)
+	}
+
+	var result struct {
+		Value []struct {
+			LogicalName string `json:"LogicalName"`
+			OptionSet   struct {
+				Options []struct {
+					Value int `json:"Value"`
+					Label struct {
+						UserLocalizedLabel *struct {
+							Label string `json:"Label"`
+						} `json:"UserLocalizedLabel"`
+					} `json:"Label"`
+				} `json:"Options"`
+			} `json:"OptionSet"`
+		} `json:"value"`
+	}
+	if err := json.Unmarshal(response, &result); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal option sets for %s: %v", entityType, err)
+	}
+
+	optionSets := make(map[string][]Option, len(result.Value))
+	for _, attribute := range result.Value {
+		options := make([]Option, 0, len(attribute.OptionSet.Options))
+		for _, o := range attribute.OptionSet.Options {
+			option := Option{Value: o.Value}
+			if o.Label.UserLocalizedLabel != nil {
+				option.Label = o.Label.UserLocalizedLabel.Label
+			}
+			options = append(options, option)
+		}
+		optionSets[attribute.LogicalName] = options
+	}
+	return optionSets, nil
+}
@@ -0,0 +1,168 @@
+package dynamics
+
+import (
+	"reflect"
+	"testing"
+)
+
+// metadataXML is a trimmed $metadata document in the shape Dynamics 365 returns it
+const metadataXML = `<?xml version="1.0" encoding="utf-8"?>
+<edmx:Edmx Version="4.0" xmlns:edmx="http://docs.oasis-open.org/odata/ns/edmx">
+  <edmx:DataServices>
+    <Schema Namespace="Microsoft.Dynamics.CRM" Alias="mscrm" xmlns="http://docs.oasis-open.org/odata/ns/edm">
+      <EntityType Name="crmbaseentity" Abstract="true">
+        <Property Name="versionnumber" Type="Edm.Int64" />
+        <NavigationProperty Name="owninguser" Type="mscrm.systemuser" />
+      </EntityType>
+      <EntityType Name="systemuser" BaseType="mscrm.crmbaseentity">
+        <Key><PropertyRef Name="systemuserid" /></Key>
+        <Property Name="systemuserid" Type="Edm.Guid" />
+      </EntityType>
+      <EntityType Name="account" BaseType="mscrm.crmbaseentity">
+        <Key><PropertyRef Name="accountid" /></Key>
+        <Property Name="accountid" Type="Edm.Guid" />
+        <Property Name="name" Type="Edm.String" />
+        <Property Name="new_kundnummer" Type="Edm.String" />
+        <NavigationProperty Name="new_account_faktura" Type="Collection(mscrm.new_faktura)" Partner="new_customer_account" />
+        <Annotation Term="OData.Community.Keys.V1.AlternateKeys">
+          <Collection>
+            <Record Type="OData.Community.Keys.V1.AlternateKey">
+              <PropertyValue Property="Key">
+                <Collection>
+                  <Record Type="OData.Community.Keys.V1.PropertyRef">
+                    <PropertyValue Property="Alias" String="new_kundnummer" />
+                    <PropertyValue Property="Name" PropertyPath="new_kundnummer" />
+                  </Record>
+                </Collection>
+              </PropertyValue>
+            </Record>
+          </Collection>
+        </Annotation>
+      </EntityType>
+      <EntityType Name="new_faktura" BaseType="mscrm.crmbaseentity">
+        <Key><PropertyRef Name="new_fakturaid" /></Key>
+        <Property Name="new_fakturaid" Type="Edm.Guid" />
+        <Property Name="new_documentnumber" Type="Edm.String" />
+        <Property Name="new_series" Type="Edm.String" />
+        <Property Name="new_total" Type="Edm.Decimal" Scale="2" />
+        <NavigationProperty Name="new_customer_account" Type="mscrm.account" Nullable="false" Partner="new_account_faktura" />
+        <Annotation Term="Org.OData.Core.V1.Description" String="Fakturor från Fortnox" />
+        <Annotation Term="OData.Community.Keys.V1.AlternateKeys">
+          <Collection>
+            <Record Type="OData.Community.Keys.V1.AlternateKey">
+              <PropertyValue Property="Key">
+                <Collection>
+                  <Record Type="OData.Community.Keys.V1.PropertyRef">
+                    <PropertyValue Property="Alias" String="new_documentnumber" />
+                    <PropertyValue Property="Name" PropertyPath="new_documentnumber" />
+                  </Record>
+                </Collection>
+              </PropertyValue>
+            </Record>
+            <Record Type="OData.Community.Keys.V1.AlternateKey">
+              <PropertyValue Property="Key">
+                <Collection>
+                  <Record Type="OData.Community.Keys.V1.PropertyRef">
+                    <PropertyValue Property="Alias" String="new_series" />
+                    <PropertyValue Property="Name" PropertyPath="new_series" />
+                  </Record>
+                  <Record Type="OData.Community.Keys.V1.PropertyRef">
+                    <PropertyValue Property="Alias" String="new_documentnumber" />
+                    <PropertyValue Property="Name" PropertyPath="new_documentnumber" />
+                  </Record>
+                </Collection>
+              </PropertyValue>
+            </Record>
+          </Collection>
+        </Annotation>
+      </EntityType>
+      <EntityContainer Name="System">
+        <EntitySet Name="accounts" EntityType="Microsoft.Dynamics.CRM.account" />
+        <EntitySet Name="new_fakturas" EntityType="Microsoft.Dynamics.CRM.new_faktura" />
+        <EntitySet Name="systemusers" EntityType="Microsoft.Dynamics.CRM.systemuser" />
+      </EntityContainer>
+    </Schema>
+  </edmx:DataServices>
+</edmx:Edmx>`
+
+func TestParseMetadata(t *testing.T) {
+	m, err := ParseMetadata([]byte(metadataXML))
+	if err != nil {
+		t.Fatalf("ParseMetadata: %v", err)
+	}
+
+	invoice := m.EntitySet("new_fakturas")
+	if invoice == nil || invoice.Name != "new_faktura" {
+		t.Fatalf("EntitySet(new_fakturas) = %+v", invoice)
+	}
+	if m.EntitySet("new_faktura") != nil {
+		t.Error("EntitySet found an entity type name")
+	}
+	if m.EntityType("Microsoft.Dynamics.CRM.new_faktura") != invoice || m.EntityType("mscrm.new_faktura") != invoice {
+		t.Error("EntityType does not strip the namespace and alias")
+	}
+	if set := m.EntitySetOf("mscrm.account"); set != "accounts" {
+		t.Errorf("EntitySetOf(account) = %q", set)
+	}
+
+	if !reflect.DeepEqual(invoice.Key, []string{"new_fakturaid"}) || invoice.BaseType != "crmbaseentity" {
+		t.Errorf("key %v, base type %q", invoice.Key, invoice.BaseType)
+	}
+	if p := invoice.Property("new_total"); p == nil || p.Type != "Edm.Decimal" {
+		t.Errorf("Property(new_total) = %+v", p)
+	}
+	if invoice.Property("New_Total") != nil {
+		t.Error("Property is not case sensitive")
+	}
+
+	// Columns and relationships of the base type are inherited
+	if p := invoice.Property("versionnumber"); p == nil || p.Type != "Edm.Int64" {
+		t.Errorf("inherited Property(versionnumber) = %+v", p)
+	}
+	if n := invoice.NavigationProperty("owninguser"); n == nil || n.Target() != "systemuser" {
+		t.Errorf("inherited NavigationProperty(owninguser) = %+v", n)
+	}
+
+	customer := invoice.NavigationProperty("new_customer_account")
+	if customer == nil || customer.Collection() || customer.Target() != "account" {
+		t.Errorf("NavigationProperty(new_customer_account) = %+v", customer)
+	}
+	invoices := m.EntitySet("accounts").NavigationProperty("new_account_faktura")
+	if invoices == nil || !invoices.Collection() || invoices.Target() != "new_faktura" {
+		t.Errorf("NavigationProperty(new_account_faktura) = %+v", invoices)
+	}
+
+	wantKeys := [][]string{{"new_documentnumber"}, {"new_series", "new_documentnumber"}}
+	if !reflect.DeepEqual(invoice.AlternateKeys, wantKeys) {
+		t.Errorf("AlternateKeys = %v, want %v", invoice.AlternateKeys, wantKeys)
+	}
+	tests := []struct {
+		columns []string
+		want    bool
+	}{
+		{[]string{"new_documentnumber"}, true},
+		{[]string{"new_documentnumber", "new_series"}, true},
+		{[]string{"new_series"}, false},
+		{[]string{"new_total"}, false},
+		{[]string{"new_documentnumber", "new_series", "new_total"}, false},
+	}
+	for _, tt := range tests {
+		if got := invoice.HasAlternateKey(tt.columns...); got != tt.want {
+			t.Errorf("HasAlternateKey(%v) = %v, want %v", tt.columns, got, tt.want)
+		}
+	}
+	if m.EntitySet("systemusers").AlternateKeys != nil {
+		t.Error("systemuser has alternate keys")
+	}
+}
+
+func TestParseMetadataInvalid(t *testing.T) {
+	for name, data := range map[string]string{
+		"not xml":         "{}",
+		"no entity types": `<edmx:Edmx xmlns:edmx="http://docs.oasis-open.org/odata/ns/edmx"><edmx:DataServices /></edmx:Edmx>`,
+	} {
+		if _, err := ParseMetadata([]byte(data)); err == nil {
+			t.Errorf("%s: ParseMetadata = nil, want an error", name)
+		}
+	}
+}
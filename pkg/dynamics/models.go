@@ -0,0 +1,103 @@
+package dynamics
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Account is a customer account in Dynamics 365 (entity set accounts)
+type Account struct {
+	ID             string `json:"accountid,omitempty"`
+	Name           string `json:"name,omitempty"`
+	CustomerNumber string `json:"new_kundnummer,omitempty"` // Customer number in Fortnox
+	AccountNumber  string `json:"accountnumber,omitempty"`
+	Email          string `json:"emailaddress1,omitempty"`
+	Phone          string `json:"telephone1,omitempty"`
+	ETag           string `json:"@odata.etag,omitempty"`
+}
+
+// accountColumns are the columns read into an Account
+var accountColumns = []string{"accountid", "name", "new_kundnummer", "accountnumber", "emailaddress1", "telephone1"}
+
+// Contact is a person in Dynamics 365 (entity set contacts)
+type Contact struct {
+	ID              string `json:"contactid,omitempty"`
+	FirstName       string `json:"firstname,omitempty"`
+	LastName        string `json:"lastname,omitempty"`
+	FullName        string `json:"fullname,omitempty"`
+	Email           string `json:"emailaddress1,omitempty"`
+	Phone           string `json:"telephone1,omitempty"`
+	ParentAccountID string `json:"_parentcustomerid_value,omitempty"` // Account the contact belongs to
+	ETag            string `json:"@odata.etag,omitempty"`
+}
+
+// contactColumns are the columns read into a Contact
+var contactColumns = []string{"contactid", "firstname", "lastname", "fullname", "emailaddress1", "telephone1", "_parentcustomerid_value"}
+
+// Faktura is an invoice record as stored in Dynamics 365 (entity set new_fakturas),
+// including its ID and customer lookup. Use DynamicsInvoice to write invoices.
+type Faktura struct {
+	ID                string  `json:"new_fakturaid,omitempty"`
+	InvoiceNumber     string  `json:"new_fakturanummer"`
+	Balance           float64 `json:"new_balance"`
+	Booked            bool    `json:"new_booked"`
+	Canceled          bool    `json:"new_cancelled"`
+	DocumentNumber    string  `json:"new_documentnumber"`
+	DueDate           string  `json:"new_duedate"`
+	InvoiceDate       string  `json:"new_invoicedate"`
+	Total             float64 `json:"new_total"`
+	Distributor       int     `json:"new_distributor"`
+	CustomerAccountID string  `json:"_new_customer_account_value,omitempty"`
+	ETag              string  `json:"@odata.etag,omitempty"`
+}
+
+// fakturaColumns are the columns read into a Faktura
+var fakturaColumns = []string{"new_fakturaid", "new_fakturanummer", "new_balance", "new_booked", "new_cancelled", "new_documentnumber", "new_duedate", "new_invoicedate", "new_total", "new_distributor", "_new_customer_account_value"}
+
+// Invoice returns the invoice columns of the record
+func (f Faktura) Invoice() DynamicsInvoice {
+	return DynamicsInvoice{
+		InvoiceNumber:  f.InvoiceNumber,
+		Balance:        f.Balance,
+		Booked:         f.Booked,
+		Canceled:       f.Canceled,
+		DocumentNumber: f.DocumentNumber,
+		DueDate:        f.DueDate,
+		InvoiceDate:    f.InvoiceDate,
+		Total:          f.Total,
+		Distributor:    f.Distributor,
+	}
+}
+
+// DecodeCollection decodes the value array of an OData collection response into a slice of T
+func DecodeCollection[T any](data []byte) ([]T, error) {
+	var collection struct {
+		Value []T `json:"value"`
+	}
+	if err := json.Unmarshal(data, &collection); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal collection: %v", err)
+	}
+	return collection.Value, nil
+}
+
+// Collect reads all remaining records of a query iterator into a slice of T
+func Collect[T any](it *QueryIterator) ([]T, error) {
+	var records []T
+	for it.Next() {
+		var record T
+		if err := it.Decode(&record); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal record: %v", err)
+		}
+		records = append(records, record)
+	}
+	return records, it.Err()
+}
+
+// first returns the first record of an OData collection response, or nil if it is empty
+func first[T any](data []byte) (*T, error) {
+	records, err := DecodeCollection[T](data)
+	if err != nil || len(records) == 0 {
+		return nil, err
+	}
+	return &records[0], nil
+}
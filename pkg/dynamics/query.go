@@ -0,0 +1,320 @@
+package dynamics
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// GUID is a record ID, written unquoted in filter expressions
+type GUID string
+
+// Filter is an OData $filter expression built with the functions below,
+// which format and escape values so they can be taken from user data
+type Filter struct {
+	expr string
+}
+
+// String returns the expression as it is sent in $filter
+func (f Filter) String() string {
+	return f.expr
+}
+
+// Eq matches records where column equals value
+func Eq(column string, value interface{}) Filter { return compare(column, "eq", value) }
+
+// Ne matches records where column does not equal value
+func Ne(column string, value interface{}) Filter { return compare(column, "ne", value) }
+
+// Gt matches records where column is greater than value
+func Gt(column string, value interface{}) Filter { return compare(column, "gt", value) }
+
+// Ge matches records where column is greater than or equal to value
+func Ge(column string, value interface{}) Filter { return compare(column, "ge", value) }
+
+// Lt matches records where column is less than value
+func Lt(column string, value interface{}) Filter { return compare(column, "lt", value) }
+
+// Le matches records where column is less than or equal to value
+func Le(column string, value interface{}) Filter { return compare(column, "le", value) }
+
+func compare(column, operator string, value interface{}) Filter {
+	return Filter{expr: fmt.Sprintf("%s %s %s", column, operator, literal(value))}
+}
+
+// Contains matches records where the text column contains value
+func Contains(column, value string) Filter {
+	return Filter{expr: fmt.Sprintf("contains(%s,%s)", column, literal(value))}
+}
+
+// StartsWith matches records where the text column starts with value
+func StartsWith(column, value string) Filter {
+	return Filter{expr: fmt.Sprintf("startswith(%s,%s)", column, literal(value))}
+}
+
+// And matches records that match all filters
+func And(filters ...Filter) Filter { return join("and", filters) }
+
+// Or matches records that match any of the filters
+func Or(filters ...Filter) Filter { return join("or", filters) }
+
+// Not matches records that do not match filter
+func Not(filter Filter) Filter {
+	return Filter{expr: fmt.Sprintf("not (%s)", filter.expr)}
+}
+
+func join(operator string, filters []Filter) Filter {
+	if len(filters) == 1 {
+		return filters[0]
+	}
+	exprs := make([]string, len(filters))
+	for i, filter := range filters {
+		exprs[i] = "(" + filter.expr + ")"
+	}
+	return Filter{expr: strings.Join(exprs, " "+operator+" ")}
+}
+
+// literal formats a value as an OData literal. Strings are quoted with embedded
+// quotes doubled, times are written in UTC and nil is null.
+func literal(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "'" + strings.ReplaceAll(v, "'", "''") + "'"
+	case GUID:
+		return string(v)
+	case bool:
+		return strconv.FormatBool(v)
+	case time.Time:
+		return v.UTC().Format(time.RFC3339)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', -1, 32)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// Query describes a request for records, built with NewQuery and the methods below
+type Query struct {
+	resource    string
+	filter      *Filter
+	selects     []string
+	expand      []string
+	orderBy     []string
+	top         int
+	count       bool
+	maxPageSize int
+}
+
+// NewQuery starts a query on an entity set such as "accounts", or on a single record
+// such as "new_fakturas(<id>)"
+func NewQuery(resource string) *Query {
+	return &Query{resource: resource}
+}
+
+// Filter sets the $filter expression
+func (q *Query) Filter(filter Filter) *Query {
+	q.filter = &filter
+	return q
+}
+
+// Select limits the returned columns
+func (q *Query) Select(columns ...string) *Query {
+	q.selects = append(q.selects, columns...)
+	return q
+}
+
+// Expand includes the records behind a navigation property, optionally limited to the given columns
+func (q *Query) Expand(navigationProperty string, columns ...string) *Query {
+	if len(columns) > 0 {
+		navigationProperty = fmt.Sprintf("%s($select=%s)", navigationProperty, strings.Join(columns, ","))
+	}
+	q.expand = append(q.expand, navigationProperty)
+	return q
+}
+
+// OrderBy sorts the records by column in ascending order, after any earlier sort columns
+func (q *Query) OrderBy(column string) *Query {
+	q.orderBy = append(q.orderBy, column+" asc")
+	return q
+}
+
+// OrderByDesc sorts the records by column in descending order, after any earlier sort columns
+func (q *Query) OrderByDesc(column string) *Query {
+	q.orderBy = append(q.orderBy, column+" desc")
+	return q
+}
+
+// Top limits the number of records returned. Dynamics 365 does not page a query with $top.
+func (q *Query) Top(n int) *Query {
+	q.top = n
+	return q
+}
+
+// Count asks for the total number of matching records, available from QueryIterator.Count
+func (q *Query) Count() *Query {
+	q.count = true
+	return q
+}
+
+// MaxPageSize sets how many records are returned per page, sent as the odata.maxpagesize preference
+func (q *Query) MaxPageSize(n int) *Query {
+	q.maxPageSize = n
+	return q
+}
+
+// String returns the query as an endpoint for GetRequest
+func (q *Query) String() string {
+	var options []string
+	add := func(name, value string) {
+		options = append(options, name+"="+strings.ReplaceAll(url.QueryEscape(value), "+", "%20"))
+	}
+
+	if q.filter != nil {
+		add("$filter", q.filter.expr)
+	}
+	if len(q.selects) > 0 {
+		add("$select", strings.Join(q.selects, ","))
+	}
+	if len(q.expand) > 0 {
+		add("$expand", strings.Join(q.expand, ","))
+	}
+	if len(q.orderBy) > 0 {
+		add("$orderby", strings.Join(q.orderBy, ","))
+	}
+	if q.top > 0 {
+		add("$top", strconv.Itoa(q.top))
+	}
+	if q.count {
+		add("$count", "true")
+	}
+
+	if len(options) == 0 {
+		return q.resource
+	}
+	return q.resource + "?" + strings.Join(options, "&")
+}
+
+// QueryIterator walks the records of a query page by page, following @odata.nextLink
+//
+//	it := d.Query(query)
+//	for it.Next() {
+//		var account Account
+//		err := it.Decode(&account)
+//	}
+//	if err := it.Err(); err != nil { ... }
+type QueryIterator struct {
+	d           *D365
+	ctx         context.Context
+	next        string
+	maxPageSize int
+
+	page    []json.RawMessage
+	current json.RawMessage
+	count   *int
+	err     error
+}
+
+// Query runs the query and returns an iterator over the matching records
+func (d *D365) Query(q *Query) *QueryIterator {
+	return d.QueryContext(context.Background(), q)
+}
+
+// QueryContext is like Query but carries a context
+func (d *D365) QueryContext(ctx context.Context, q *Query) *QueryIterator {
+	return &QueryIterator{d: d, ctx: ctx, next: q.String(), maxPageSize: q.maxPageSize}
+}
+
+// Next advances to the next record, fetching the next page when needed.
+// It returns false when there are no more records or a request failed.
+func (it *QueryIterator) Next() bool {
+	for len(it.page) == 0 {
+		if it.err != nil || it.next == "" {
+			return false
+		}
+		it.fetch()
+	}
+
+	it.current, it.page = it.page[0], it.page[1:]
+	return true
+}
+
+// fetch requests the page at it.next
+func (it *QueryIterator) fetch() {
+	endpoint := it.next
+	it.next = ""
+
+	resp, err := it.d.do(it.ctx, resty.MethodGet, endpoint, func(r *resty.Request) *resty.Request {
+		if it.maxPageSize > 0 {
+			r.SetHeader("Prefer", fmt.Sprintf("odata.maxpagesize=%d", it.maxPageSize))
+		}
+		return r
+	})
+	if err != nil {
+		it.err = err
+		return
+	}
+	if resp.StatusCode() != 200 {
+		it.err = newODataError(resp.StatusCode(), resp.Body())
+		return
+	}
+
+	var page struct {
+		Value    []json.RawMessage `json:"value"`
+		Count    *int              `json:"@odata.count"`
+		NextLink string            `json:"@odata.nextLink"`
+	}
+	if err := json.Unmarshal(resp.Body(), &page); err != nil {
+		it.err = fmt.Errorf("failed to unmarshal query response: %v", err)
+		return
+	}
+
+	it.page = page.Value
+	if page.Count != nil {
+		it.count = page.Count
+	}
+	if page.NextLink != "" {
+		it.next, it.err = it.d.relativeEndpoint(page.NextLink)
+	}
+}
+
+// Value returns the raw JSON of the current record
+func (it *QueryIterator) Value() json.RawMessage {
+	return it.current
+}
+
+// Decode unmarshals the current record into v
+func (it *QueryIterator) Decode(v interface{}) error {
+	return json.Unmarshal(it.current, v)
+}
+
+// Count returns the total number of matching records, if the query asked for it with Count
+func (it *QueryIterator) Count() (int, bool) {
+	if it.count == nil {
+		return 0, false
+	}
+	return *it.count, true
+}
+
+// Err returns the error that stopped the iteration, if any
+func (it *QueryIterator) Err() error {
+	return it.err
+}
+
+// relativeEndpoint turns an absolute Web API URL, such as an @odata.nextLink, into an endpoint
+func (d *D365) relativeEndpoint(link string) (string, error) {
+	endpoint, ok := strings.CutPrefix(link, d.URL+"/api/data/v9.2/")
+	if !ok {
+		return "", fmt.Errorf("next link %q is outside the Web API at %s", link, d.URL)
+	}
+	return endpoint, nil
+}
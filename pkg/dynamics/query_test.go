@@ -0,0 +1,117 @@
+package dynamics
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestFilter(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter Filter
+		want   string
+	}{
+		{"string", Eq("name", "Kund AB"), "name eq 'Kund AB'"},
+		{"apostrophe", Eq("name", "O'Brien"), "name eq 'O''Brien'"},
+		{"only apostrophes", Eq("name", "''"), "name eq ''''''"},
+		{"injection", Eq("accountnumber", "1' or accountnumber ne '"), "accountnumber eq '1'' or accountnumber ne '''"},
+		{"guid", Eq("accountid", GUID("0a8f1e2d-1a2b-ef11-8ee8-000d3ab8c4f1")), "accountid eq 0a8f1e2d-1a2b-ef11-8ee8-000d3ab8c4f1"},
+		{"nil", Eq("new_duedate", nil), "new_duedate eq null"},
+		{"int", Gt("new_total", 100), "new_total gt 100"},
+		{"float", Le("new_total", 1234.5), "new_total le 1234.5"},
+		{"large float", Ge("new_total", 1e21), "new_total ge 1000000000000000000000"},
+		{"float32", Lt("new_total", float32(0.1)), "new_total lt 0.1"},
+		{"bool", Ne("new_cancelled", true), "new_cancelled ne true"},
+		{"time", Ge("modifiedon", time.Date(2024, 5, 2, 15, 45, 0, 0, time.FixedZone("CEST", 2*60*60))), "modifiedon ge 2024-05-02T13:45:00Z"},
+		{"contains", Contains("name", "O'Brien"), "contains(name,'O''Brien')"},
+		{"starts with", StartsWith("accountnumber", "10"), "startswith(accountnumber,'10')"},
+		{"and", And(Eq("a", 1), Eq("b", "x")), "(a eq 1) and (b eq 'x')"},
+		{"or of one", Or(Eq("a", 1)), "a eq 1"},
+		{"not", Not(Eq("a", nil)), "not (a eq null)"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.filter.String(); got != tt.want {
+			t.Errorf("%s: filter = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestQueryString(t *testing.T) {
+	tests := []struct {
+		name  string
+		query *Query
+		want  string
+	}{
+		{"resource only", NewQuery("accounts"), "accounts"},
+		{
+			"select and filter",
+			NewQuery("accounts").Select("accountid", "name").Filter(Eq("accountnumber", "10")),
+			"accounts?$filter=accountnumber%20eq%20%2710%27&$select=accountid%2Cname",
+		},
+		{
+			// & and # would end the option or the URL, and + would be read as a space
+			"special characters",
+			NewQuery("accounts").Filter(Eq("name", "A&B #1 + C")),
+			"accounts?$filter=name%20eq%20%27A%26B%20%231%20%2B%20C%27",
+		},
+		{
+			"apostrophe",
+			NewQuery("contacts").Filter(Eq("lastname", "O'Brien")),
+			"contacts?$filter=lastname%20eq%20%27O%27%27Brien%27",
+		},
+		{
+			"all options",
+			NewQuery("new_fakturas").Expand("new_customer", "name").OrderBy("new_documentnumber").OrderByDesc("modifiedon").Top(5).Count(),
+			"new_fakturas?$expand=new_customer%28%24select%3Dname%29&$orderby=new_documentnumber%20asc%2Cmodifiedon%20desc&$top=5&$count=true",
+		},
+	}
+
+	for _, tt := range tests {
+		got := tt.query.String()
+		if got != tt.want {
+			t.Errorf("%s: query = %q, want %q", tt.name, got, tt.want)
+			continue
+		}
+
+		// The options decode back to the expressions that were built
+		if tt.query.filter != nil {
+			u, err := url.Parse(got)
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			if filter := u.Query().Get("$filter"); filter != tt.query.filter.String() {
+				t.Errorf("%s: decoded $filter = %q, want %q", tt.name, filter, tt.query.filter.String())
+			}
+		}
+	}
+}
+
+func TestRelativeEndpoint(t *testing.T) {
+	d := &D365{URL: "https://org.crm4.dynamics.com"}
+
+	tests := []struct {
+		name    string
+		link    string
+		want    string
+		wantErr bool
+	}{
+		{
+			"next link",
+			"https://org.crm4.dynamics.com/api/data/v9.2/accounts?$select=name&$skiptoken=%3Ccookie%20pagenumber=%222%22%20/%3E",
+			"accounts?$select=name&$skiptoken=%3Ccookie%20pagenumber=%222%22%20/%3E",
+			false,
+		},
+		{"other organisation", "https://other.crm4.dynamics.com/api/data/v9.2/accounts", "", true},
+		{"other api version", "https://org.crm4.dynamics.com/api/data/v9.1/accounts", "", true},
+		{"relative", "accounts?$skiptoken=1", "", true},
+	}
+
+	for _, tt := range tests {
+		got, err := d.relativeEndpoint(tt.link)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("%s: relativeEndpoint = %q, %v, want %q, error %v", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package dynamics
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// Record is a row of any Dynamics 365 table, keyed by column name. Lookups are set with
+// Bind and sent as @odata.bind annotations.
+type Record map[string]interface{}
+
+// Bind sets the lookup behind navigationProperty to the record with the given ID in entitySet
+func (r Record) Bind(navigationProperty, entitySet, id string) {
+	r[BindAnnotation(navigationProperty)] = EntityReference(entitySet, id)
+}
+
+// CreateRecord creates a record in entitySet and returns its ID
+func (d *D365) CreateRecord(entitySet string, record interface{}) (string, error) {
+	return d.CreateRecordContext(context.Background(), entitySet, record)
+}
+
+// CreateRecordContext is like CreateRecord but carries a context
+func (d *D365) CreateRecordContext(ctx context.Context, entitySet string, record interface{}) (string, error) {
+	resp, err := d.do(ctx, resty.MethodPost, entitySet, func(r *resty.Request) *resty.Request {
+		return r.
+			SetHeader("Content-Type", "application/json; charset=utf-8").
+			SetBody(record)
+	})
+
+	if err != nil {
+		return "", fmt.Errorf("failed to create record: %w", err)
+	}
+
+	if resp.StatusCode() != 201 && resp.StatusCode() != 204 {
+		return "", fmt.Errorf("failed to create record: %w", newODataError(resp.StatusCode(), resp.Body()))
+	}
+
+	id := entityIDFromHeader(resp.Header())
+	if id == "" {
+		return "", fmt.Errorf("failed to create record: no OData-EntityId in the response")
+	}
+	return id, nil
+}
+
+// GetRecord fetches the given columns of a record, or all columns if none are given
+func (d *D365) GetRecord(entitySet, id string, columns ...string) (Record, error) {
+	return d.GetRecordContext(context.Background(), entitySet, id, columns...)
+}
+
+// GetRecordContext is like GetRecord but carries a context
+func (d *D365) GetRecordContext(ctx context.Context, entitySet, id string, columns ...string) (Record, error) {
+	query := NewQuery(fmt.Sprintf("%s(%s)", entitySet, id)).Select(columns...)
+	response, err := d.GetRequestContext(ctx, query.String())
+	if err != nil {
+		return nil, err
+	}
+
+	var record Record
+	if err := json.Unmarshal(response, &record); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal record: %v", err)
+	}
+	return record, nil
+}
+
+// UpdateRecord updates the given columns of a record
+func (d *D365) UpdateRecord(entitySet, id string, changes map[string]interface{}) error {
+	return d.UpdateRecordContext(context.Background(), entitySet, id, changes)
+}
+
+// UpdateRecordContext is like UpdateRecord but carries a context
+func (d *D365) UpdateRecordContext(ctx context.Context, entitySet, id string, changes map[string]interface{}) error {
+	_, err := d.PatchRequestContext(ctx, fmt.Sprintf("%s(%s)", entitySet, id), changes)
+	if err != nil {
+		return fmt.Errorf("failed to update record: %w", err)
+	}
+	return nil
+}
+
+// DeleteRecord deletes a record
+func (d *D365) DeleteRecord(entitySet, id string) error {
+	return d.DeleteRecordContext(context.Background(), entitySet, id)
+}
+
+// DeleteRecordContext is like DeleteRecord but carries a context
+func (d *D365) DeleteRecordContext(ctx context.Context, entitySet, id string) error {
+	err := d.DeleteRequestContext(ctx, fmt.Sprintf("%s(%s)", entitySet, id))
+	if err != nil {
+		return fmt.Errorf("failed to delete record: %w", err)
+	}
+	return nil
+}
+
+// FindRecordID returns the ID, read from idColumn, of the first record in entitySet matching
+// filter, or an empty string if there is none
+func (d *D365) FindRecordID(entitySet, idColumn string, filter Filter) (string, error) {
+	return d.FindRecordIDContext(context.Background(), entitySet, idColumn, filter)
+}
+
+// FindRecordIDContext is like FindRecordID but carries a context
+func (d *D365) FindRecordIDContext(ctx context.Context, entitySet, idColumn string, filter Filter) (string, error) {
+	query := NewQuery(entitySet).Filter(filter).Select(idColumn).Top(1)
+	response, err := d.GetRequestContext(ctx, query.String())
+	if err != nil {
+		return "", err
+	}
+
+	records, err := DecodeCollection[Record](response)
+	if err != nil || len(records) == 0 {
+		return "", err
+	}
+	id, _ := records[0][idColumn].(string)
+	return id, nil
+}
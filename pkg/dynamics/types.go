@@ -12,7 +12,8 @@ type Token struct {
 	AccessToken  string 		 `json:"access_token"`
 }
 
-// DynamicsInvoice represents the structure of an invoice to be saved in Dynamics 365
+// DynamicsInvoice represents the structure of an invoice to be saved in Dynamics 365.
+// Lookup columns are set with Bind and sent as @odata.bind annotations.
 type DynamicsInvoice struct {
 	InvoiceNumber  string  `json:"new_fakturanummer"`
 	Balance        float64 `json:"new_balance"`
@@ -23,5 +24,7 @@ type DynamicsInvoice struct {
 	InvoiceDate    string  `json:"new_invoicedate"`
 	Total          float64 `json:"new_total"`
 	Distributor    int     `json:"new_distributor"`
+
+	Bindings map[string]string `json:"-"` // Navigation property to entity reference, see Bind
 }
 
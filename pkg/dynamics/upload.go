@@ -1,26 +1,44 @@
 package dynamics
 
 import (
+	"context"
 	"fmt"
+
+	"github.com/go-resty/resty/v2"
 )
 
 // UploadFile uploads a file to a specified entity in Dynamics 365
 func (d *D365) UploadFile(entityID, field, filename string, fileData []byte) error {
-    endpoint := fmt.Sprintf("new_fakturas(%s)/%s", entityID, field)
-    resp, err := d.Resty.R().
-        SetHeader("Authorization", fmt.Sprintf("Bearer %v", d.AccessToken)).
-        SetHeader("Content-Type", "application/octet-stream").
-        SetHeader("x-ms-file-name", filename).
-        SetBody(fileData).
-        Put(d.URL + "/api/data/v9.2/" + endpoint)
-
-    if err != nil {
-        return fmt.Errorf("error uploading file: %v", err)
-    }
-
-    if resp.StatusCode() != 200 && resp.StatusCode() != 204 {
-        return fmt.Errorf("error uploading file: %v", resp.String())
-    }
-
-    return nil
+	return d.UploadFileContext(context.Background(), entityID, field, filename, fileData)
+}
+
+// UploadFileContext is like UploadFile but carries a context
+func (d *D365) UploadFileContext(ctx context.Context, entityID, field, filename string, fileData []byte) error {
+	return d.UploadFileToContext(ctx, "new_fakturas", entityID, field, filename, fileData)
+}
+
+// UploadFileTo uploads a file to a file column of a record in any entity set
+func (d *D365) UploadFileTo(entitySet, entityID, field, filename string, fileData []byte) error {
+	return d.UploadFileToContext(context.Background(), entitySet, entityID, field, filename, fileData)
+}
+
+// UploadFileToContext is like UploadFileTo but carries a context
+func (d *D365) UploadFileToContext(ctx context.Context, entitySet, entityID, field, filename string, fileData []byte) error {
+	endpoint := fmt.Sprintf("%s(%s)/%s", entitySet, entityID, field)
+	resp, err := d.do(ctx, resty.MethodPut, endpoint, func(r *resty.Request) *resty.Request {
+		return r.
+			SetHeader("Content-Type", "application/octet-stream").
+			SetHeader("x-ms-file-name", filename).
+			SetBody(fileData)
+	})
+
+	if err != nil {
+		return fmt.Errorf("error uploading file: %w", err)
+	}
+
+	if resp.StatusCode() != 200 && resp.StatusCode() != 204 {
+		return fmt.Errorf("error uploading file: %w", newODataError(resp.StatusCode(), resp.Body()))
+	}
+
+	return nil
 }
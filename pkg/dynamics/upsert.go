@@ -0,0 +1,141 @@
+package dynamics
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// UpsertCondition limits whether an upsert may create a record, update one, or both
+type UpsertCondition int
+
+const (
+	UpsertAny  UpsertCondition = iota // Create the record if it does not exist, otherwise update it
+	CreateOnly                        // Sent with If-None-Match: *, fails with 412 if the record exists
+	UpdateOnly                        // Sent with If-Match: *, fails with 404 if the record does not exist
+)
+
+// header returns the request headers that apply the condition
+func (c UpsertCondition) header() http.Header {
+	header := http.Header{}
+	header.Set("Prefer", "return=representation")
+	switch c {
+	case CreateOnly:
+		header.Set("If-None-Match", "*")
+	case UpdateOnly:
+		header.Set("If-Match", "*")
+	}
+	return header
+}
+
+// UpsertResult describes the record written by an upsert
+type UpsertResult struct {
+	ID      string // Primary key of the record, from the OData-EntityId header
+	Created bool   // The record did not exist before
+	Body    []byte // The record as returned by Dynamics 365
+}
+
+// RecordID returns the ID of the upserted record. It is read from the OData-EntityId header,
+// unless the header refers to the record by its alternate key, and otherwise from idColumn
+// in the returned record.
+func (r UpsertResult) RecordID(idColumn string) string {
+	return recordID(r.ID, r.Body, idColumn)
+}
+
+// RecordID is like UpsertResult.RecordID for an operation added with Batch.Upsert or Batch.Post
+func (op *BatchOperation) RecordID(idColumn string) string {
+	return recordID(op.EntityID(), op.Response, idColumn)
+}
+
+func recordID(entityID string, body []byte, idColumn string) string {
+	if entityID != "" && !strings.Contains(entityID, "=") {
+		return entityID
+	}
+
+	var record map[string]interface{}
+	if json.Unmarshal(body, &record) != nil {
+		return ""
+	}
+	id, _ := record[idColumn].(string)
+	return id
+}
+
+// AlternateKeyEndpoint returns the endpoint that addresses a record in entitySet by the
+// columns of an alternate key, for example new_fakturas(new_documentnumber='1001')
+func AlternateKeyEndpoint(entitySet string, alternateKey map[string]interface{}) string {
+	columns := make([]string, 0, len(alternateKey))
+	for column := range alternateKey {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+
+	parts := make([]string, len(columns))
+	for i, column := range columns {
+		parts[i] = column + "=" + keyValue(alternateKey[column])
+	}
+	return fmt.Sprintf("%s(%s)", entitySet, strings.Join(parts, ","))
+}
+
+// keyValue formats a key value as an OData literal, quoting and escaping strings
+func keyValue(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return "'" + url.PathEscape(strings.ReplaceAll(s, "'", "''")) + "'"
+	}
+	return fmt.Sprint(value)
+}
+
+// Upsert creates or updates the record in entitySet identified by alternateKey, in a single
+// PATCH request. The entity must have an alternate key defined on the given columns.
+func (d *D365) Upsert(entitySet string, alternateKey map[string]interface{}, body interface{}, condition UpsertCondition) (UpsertResult, error) {
+	return d.UpsertContext(context.Background(), entitySet, alternateKey, body, condition)
+}
+
+// UpsertContext is like Upsert but carries a context
+func (d *D365) UpsertContext(ctx context.Context, entitySet string, alternateKey map[string]interface{}, body interface{}, condition UpsertCondition) (UpsertResult, error) {
+	resp, err := d.do(ctx, resty.MethodPatch, AlternateKeyEndpoint(entitySet, alternateKey), func(r *resty.Request) *resty.Request {
+		return r.
+			SetHeader("Content-Type", "application/json; charset=utf-8").
+			SetHeaderMultiValues(condition.header()).
+			SetBody(body)
+	})
+
+	if err != nil {
+		return UpsertResult{}, err
+	}
+
+	if resp.StatusCode() != 200 && resp.StatusCode() != 201 && resp.StatusCode() != 204 {
+		return UpsertResult{}, newODataError(resp.StatusCode(), resp.Body())
+	}
+
+	return UpsertResult{
+		ID:      entityIDFromHeader(resp.Header()),
+		Created: resp.StatusCode() == 201,
+		Body:    resp.Body(),
+	}, nil
+}
+
+// Upsert adds an upsert of the record identified by alternateKey to the batch. Once the
+// batch has run, a StatusCode of 201 means the record was created.
+func (b *Batch) Upsert(entitySet string, alternateKey map[string]interface{}, body interface{}, condition UpsertCondition) *BatchOperation {
+	return b.add(upsertOperation(entitySet, alternateKey, body, condition))
+}
+
+// Upsert adds an upsert of the record identified by alternateKey to the change set
+func (cs *ChangeSet) Upsert(entitySet string, alternateKey map[string]interface{}, body interface{}, condition UpsertCondition) *BatchOperation {
+	return cs.add(upsertOperation(entitySet, alternateKey, body, condition))
+}
+
+func upsertOperation(entitySet string, alternateKey map[string]interface{}, body interface{}, condition UpsertCondition) *BatchOperation {
+	return &BatchOperation{
+		Method:   resty.MethodPatch,
+		Endpoint: AlternateKeyEndpoint(entitySet, alternateKey),
+		Body:     body,
+		Header:   condition.header(),
+	}
+}
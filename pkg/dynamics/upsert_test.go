@@ -0,0 +1,84 @@
+package dynamics
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestAlternateKeyEndpoint(t *testing.T) {
+	tests := []struct {
+		name string
+		key  map[string]interface{}
+		want string
+	}{
+		{"string", map[string]interface{}{"new_documentnumber": "1001"}, "new_fakturas(new_documentnumber='1001')"},
+		// The doubled quote is path escaped along with the rest of the value
+		{"apostrophe", map[string]interface{}{"new_documentnumber": "O'Brien"}, "new_fakturas(new_documentnumber='O%27%27Brien')"},
+		{"path characters", map[string]interface{}{"new_documentnumber": "A/1 #2?"}, "new_fakturas(new_documentnumber='A%2F1%20%232%3F')"},
+		{"number", map[string]interface{}{"new_number": 1001}, "new_fakturas(new_number=1001)"},
+		{
+			"columns in sorted order",
+			map[string]interface{}{"new_series": "B", "new_documentnumber": "1001", "new_company": 5},
+			"new_fakturas(new_company=5,new_documentnumber='1001',new_series='B')",
+		},
+	}
+
+	for _, tt := range tests {
+		if got := AlternateKeyEndpoint("new_fakturas", tt.key); got != tt.want {
+			t.Errorf("%s: AlternateKeyEndpoint = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestUpsertRecordID(t *testing.T) {
+	const id = "6c2b3f4e-1a2b-ef11-8ee8-000d3ab8c4f1"
+	body := []byte(`{"new_fakturaid":"` + id + `","new_documentnumber":"1001"}`)
+
+	tests := []struct {
+		name     string
+		entityID string
+		body     []byte
+		want     string
+	}{
+		{"primary key", "https://org.crm4.dynamics.com/api/data/v9.2/new_fakturas(" + id + ")", nil, id},
+		{"alternate key", "https://org.crm4.dynamics.com/api/data/v9.2/new_fakturas(new_documentnumber='1001')", body, id},
+		{"no header", "", body, id},
+		{"alternate key without body", "https://org.crm4.dynamics.com/api/data/v9.2/new_fakturas(new_documentnumber='1001')", nil, ""},
+	}
+
+	for _, tt := range tests {
+		header := http.Header{}
+		if tt.entityID != "" {
+			header.Set("OData-EntityId", tt.entityID)
+		}
+
+		result := UpsertResult{ID: entityIDFromHeader(header), Body: tt.body}
+		if got := result.RecordID("new_fakturaid"); got != tt.want {
+			t.Errorf("%s: UpsertResult.RecordID = %q, want %q", tt.name, got, tt.want)
+		}
+
+		op := &BatchOperation{ResponseHeader: header, Response: tt.body}
+		if got := op.RecordID("new_fakturaid"); got != tt.want {
+			t.Errorf("%s: BatchOperation.RecordID = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestUpsertConditionHeader(t *testing.T) {
+	tests := []struct {
+		condition   UpsertCondition
+		ifMatch     string
+		ifNoneMatch string
+	}{
+		{UpsertAny, "", ""},
+		{CreateOnly, "", "*"},
+		{UpdateOnly, "*", ""},
+	}
+
+	for _, tt := range tests {
+		header := tt.condition.header()
+		if header.Get("If-Match") != tt.ifMatch || header.Get("If-None-Match") != tt.ifNoneMatch || header.Get("Prefer") != "return=representation" {
+			t.Errorf("condition %d: header = %v", tt.condition, header)
+		}
+	}
+}
@@ -1,8 +1,10 @@
 package fortnox
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"net/url"
 )
 
 // FetchInvoices fetches invoices from the Fortnox API based on the provided filters.
@@ -12,6 +14,11 @@ import (
 // The function retrieves invoices in batches using pagination, with a default limit of 500 invoices per page.
 // It continues fetching invoices until all pages have been retrieved or an error occurs.
 func (c *FortnoxClient) FetchInvoices(filters map[string]string) ([]Invoice, error) {
+	return c.FetchInvoicesContext(context.Background(), filters)
+}
+
+// FetchInvoicesContext is like FetchInvoices but stops fetching further pages when ctx is done
+func (c *FortnoxClient) FetchInvoicesContext(ctx context.Context, filters map[string]string) ([]Invoice, error) {
 	var allInvoices []Invoice
 	page := 1
 	limit := 500
@@ -19,10 +26,10 @@ func (c *FortnoxClient) FetchInvoices(filters map[string]string) ([]Invoice, err
 	for {
 		query := fmt.Sprintf("limit=%d&page=%d", limit, page)
 		for key, value := range filters {
-			query += fmt.Sprintf("&%s=%s", key, value)
+			query += fmt.Sprintf("&%s=%s", key, url.QueryEscape(value))
 		}
 		endpoint := fmt.Sprintf("/invoices?%s", query)
-		respBody, err := c.makeAPIRequest("GET", endpoint, nil)
+		respBody, err := c.makeAPIRequest(ctx, "GET", endpoint, nil)
 		if err != nil {
 			return nil, err
 		}
@@ -43,9 +50,34 @@ func (c *FortnoxClient) FetchInvoices(filters map[string]string) ([]Invoice, err
 	return allInvoices, nil
 }
 
+// FetchInvoice fetches a single invoice with all its fields and rows, which the invoice list leaves out
+func (c *FortnoxClient) FetchInvoice(documentNumber string) (*Invoice, error) {
+	return c.FetchInvoiceContext(context.Background(), documentNumber)
+}
+
+// FetchInvoiceContext is like FetchInvoice but carries a context
+func (c *FortnoxClient) FetchInvoiceContext(ctx context.Context, documentNumber string) (*Invoice, error) {
+	endpoint := fmt.Sprintf("/invoices/%s", url.PathEscape(documentNumber))
+	respBody, err := c.makeAPIRequest(ctx, "GET", endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var invoiceResponse InvoiceResponse
+	if err := json.Unmarshal(respBody, &invoiceResponse); err != nil {
+		return nil, err
+	}
+	return &invoiceResponse.Invoice, nil
+}
+
 // FetchInvoicePDF fetches the PDF preview of an invoice from the Fortnox API.
 // It takes the invoiceNumber as a parameter and returns the PDF data as a byte slice and an error if any.
 func (c *FortnoxClient) FetchInvoicePDF(invoiceNumber string) ([]byte, error) {
+	return c.FetchInvoicePDFContext(context.Background(), invoiceNumber)
+}
+
+// FetchInvoicePDFContext is like FetchInvoicePDF but carries a context
+func (c *FortnoxClient) FetchInvoicePDFContext(ctx context.Context, invoiceNumber string) ([]byte, error) {
 	endpoint := fmt.Sprintf("/invoices/%s/preview", invoiceNumber)
-	return c.makeAPIRequest("GET", endpoint, nil)
+	return c.makeAPIRequest(ctx, "GET", endpoint, nil)
 }
@@ -4,34 +4,49 @@ package fortnox
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"html/template"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
-	"os/exec"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/joho/godotenv"
+
+	"fortnox_dynamics_integration/pkg/retry"
 )
 
 const (
 	authorizationEndpoint = "https://apps.fortnox.se/oauth-v1/auth"
 	tokenEndpoint         = "https://apps.fortnox.se/oauth-v1/token"
+	defaultAuthTimeout    = 5 * time.Minute
 )
 
 type FortnoxClient struct {
-	ClientID     string
-	ClientSecret string
-	RedirectURI  string
-	Scopes       string
-	APIBaseURL   string
-	AccessToken  string
-	RefreshToken string
-	ExpiresAt    time.Time
-	AuthDone     chan bool
+	ClientID       string
+	ClientSecret   string
+	RedirectURI    string
+	Scopes         string
+	APIBaseURL     string
+	AccessToken    string
+	RefreshToken   string
+	ExpiresAt      time.Time
+	UsePKCE        bool
+	AuthTimeout    time.Duration
+	RequestTimeout time.Duration
+	TokenStore     TokenStore
+	RateLimiter    *RateLimiter
+	RetryPolicy    retry.Policy
+
+	// tokenMu serialises token refreshes between concurrent requests
+	tokenMu sync.Mutex
 }
 
 type TokenResponse struct {
@@ -40,54 +55,130 @@ type TokenResponse struct {
 	ExpiresIn    int    `json:"expires_in"`
 }
 
+// NewFortnoxClient creates a client configured from the environment,
+// using the token store selected by NewTokenStoreFromEnv.
 func NewFortnoxClient() (*FortnoxClient, error) {
 	err := godotenv.Load()
 	if err != nil {
 		return nil, fmt.Errorf("error loading .env file: %v", err)
 	}
 
+	tokenStore, err := NewTokenStoreFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	return NewFortnoxClientWithTokenStore(tokenStore)
+}
+
+// NewFortnoxClientWithTokenStore creates a client configured from the environment
+// that loads and saves its tokens through the given store.
+func NewFortnoxClientWithTokenStore(tokenStore TokenStore) (*FortnoxClient, error) {
 	client := &FortnoxClient{
 		ClientID:     os.Getenv("FORTNOX_CLIENT_ID"),
 		ClientSecret: os.Getenv("FORTNOX_CLIENT_SECRET"),
 		RedirectURI:  os.Getenv("REDIRECT_URI"),
 		Scopes:       os.Getenv("FORTNOX_CLIENT_SCOPES"),
 		APIBaseURL:   os.Getenv("FORTNOX_API_BASE_URL"),
-		AuthDone:     make(chan bool),
+		UsePKCE:      os.Getenv("FORTNOX_USE_PKCE") == "true",
+		AuthTimeout:  defaultAuthTimeout,
+		TokenStore:   tokenStore,
+		RetryPolicy:  retry.DefaultPolicy(),
+	}
+
+	if timeout := os.Getenv("FORTNOX_AUTH_TIMEOUT"); timeout != "" {
+		d, err := time.ParseDuration(timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid FORTNOX_AUTH_TIMEOUT: %v", err)
+		}
+		client.AuthTimeout = d
+	}
+	if timeout := os.Getenv("FORTNOX_REQUEST_TIMEOUT"); timeout != "" {
+		d, err := time.ParseDuration(timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid FORTNOX_REQUEST_TIMEOUT: %v", err)
+		}
+		client.RequestTimeout = d
+	}
+
+	// FORTNOX_RATE_LIMIT requests are allowed per FORTNOX_RATE_LIMIT_PERIOD, 25 per 5s by default
+	requests, period := defaultRateLimit, defaultRateLimitPeriod
+	if limit := os.Getenv("FORTNOX_RATE_LIMIT"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil {
+			return nil, fmt.Errorf("invalid FORTNOX_RATE_LIMIT: %v", err)
+		}
+		requests = n
+	}
+	if limitPeriod := os.Getenv("FORTNOX_RATE_LIMIT_PERIOD"); limitPeriod != "" {
+		d, err := time.ParseDuration(limitPeriod)
+		if err != nil {
+			return nil, fmt.Errorf("invalid FORTNOX_RATE_LIMIT_PERIOD: %v", err)
+		}
+		period = d
 	}
+	client.RateLimiter = NewRateLimiter(requests, period)
 
-	err = client.loadTokens()
+	err := client.loadTokens()
 	if err != nil {
 		// It's okay if we can't load tokens, we might need to get new ones
-		fmt.Println("No saved tokens found. New authorization might be required.")
+		if errors.Is(err, ErrNoTokens) {
+			log.Println("No saved tokens found. New authorization might be required.")
+		} else {
+			log.Printf("Could not load saved tokens: %v. New authorization might be required.", err)
+		}
 	}
 
 	return client, nil
 }
 
+// GetAuthorizationURL returns the authorization URL for the given state without PKCE.
+// Prefer NewAuthFlow and AuthorizationURL, which generate a random state.
 func (c *FortnoxClient) GetAuthorizationURL(state string) string {
-	return fmt.Sprintf("%s?client_id=%s&redirect_uri=%s&scope=%s&state=%s&response_type=code&access_type=offline",
-		authorizationEndpoint, c.ClientID, c.RedirectURI, c.Scopes, state)
+	return c.AuthorizationURL(&AuthFlow{State: state})
 }
 
 func (c *FortnoxClient) ExchangeAuthorizationCode(code string) error {
+	return c.ExchangeAuthorizationCodeWithVerifier(code, "")
+}
+
+// ExchangeAuthorizationCodeWithVerifier exchanges an authorization code for tokens,
+// sending the PKCE code_verifier when the authorization URL carried a code_challenge.
+func (c *FortnoxClient) ExchangeAuthorizationCodeWithVerifier(code, codeVerifier string) error {
+	return c.ExchangeAuthorizationCodeContext(context.Background(), code, codeVerifier)
+}
+
+// ExchangeAuthorizationCodeContext is like ExchangeAuthorizationCodeWithVerifier but carries a context
+func (c *FortnoxClient) ExchangeAuthorizationCodeContext(ctx context.Context, code, codeVerifier string) error {
 	data := url.Values{}
 	data.Set("grant_type", "authorization_code")
 	data.Set("code", code)
 	data.Set("redirect_uri", c.RedirectURI)
+	if codeVerifier != "" {
+		data.Set("code_verifier", codeVerifier)
+	}
 
-	return c.doTokenRequest(data)
+	return c.doTokenRequest(ctx, data)
 }
 
 func (c *FortnoxClient) RefreshAccessToken() error {
+	return c.RefreshAccessTokenContext(context.Background())
+}
+
+// RefreshAccessTokenContext is like RefreshAccessToken but carries a context
+func (c *FortnoxClient) RefreshAccessTokenContext(ctx context.Context) error {
 	data := url.Values{}
 	data.Set("grant_type", "refresh_token")
 	data.Set("refresh_token", c.RefreshToken)
 
-	return c.doTokenRequest(data)
+	return c.doTokenRequest(ctx, data)
 }
 
-func (c *FortnoxClient) doTokenRequest(data url.Values) error {
-	req, err := http.NewRequest("POST", tokenEndpoint, strings.NewReader(data.Encode()))
+func (c *FortnoxClient) doTokenRequest(ctx context.Context, data url.Values) error {
+	ctx, cancel := context.WithTimeout(ctx, c.requestTimeout())
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", tokenEndpoint, strings.NewReader(data.Encode()))
 	if err != nil {
 		return err
 	}
@@ -108,7 +199,7 @@ func (c *FortnoxClient) doTokenRequest(data url.Values) error {
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("unexpected status code: %d, body: %s", resp.StatusCode, string(body))
+		return newAPIError(resp.StatusCode, body)
 	}
 
 	var tokenResp TokenResponse
@@ -124,44 +215,36 @@ func (c *FortnoxClient) doTokenRequest(data url.Values) error {
 }
 
 func (c *FortnoxClient) saveTokens() error {
-	data, err := json.Marshal(map[string]string{
-		"access_token":  c.AccessToken,
-		"refresh_token": c.RefreshToken,
-		"expires_at":    c.ExpiresAt.Format(time.RFC3339),
+	return c.TokenStore.Save(&Tokens{
+		AccessToken:  c.AccessToken,
+		RefreshToken: c.RefreshToken,
+		ExpiresAt:    c.ExpiresAt,
 	})
-	if err != nil {
-		return err
-	}
-	return os.WriteFile("fortnox_tokens.json", data, 0600)
 }
 
 func (c *FortnoxClient) loadTokens() error {
-	data, err := os.ReadFile("fortnox_tokens.json")
+	tokens, err := c.TokenStore.Load()
 	if err != nil {
 		return err
 	}
 
-	var tokens map[string]string
-	if err := json.Unmarshal(data, &tokens); err != nil {
-		return err
-	}
-
-	c.AccessToken = tokens["access_token"]
-	c.RefreshToken = tokens["refresh_token"]
-	c.ExpiresAt, _ = time.Parse(time.RFC3339, tokens["expires_at"])
+	c.AccessToken = tokens.AccessToken
+	c.RefreshToken = tokens.RefreshToken
+	c.ExpiresAt = tokens.ExpiresAt
 
 	return nil
 }
 
+// StartAuthorizationFlow opens the authorization URL in a browser and waits for
+// Fortnox to redirect back to a local callback server on RedirectURI.
+// The flow fails if no successful callback arrives within AuthTimeout.
+// Use StartHeadlessAuthorizationFlow on machines without a browser.
 func (c *FortnoxClient) StartAuthorizationFlow() error {
-	state := "some_random_state" // Change this to a more secure state if needed
-	authURL := c.GetAuthorizationURL(state)
-
-	// Open the browser with the authorization URL
-	err := exec.Command("open", authURL).Start()
+	flow, err := c.NewAuthFlow()
 	if err != nil {
-		return fmt.Errorf("failed to open browser: %v", err)
+		return err
 	}
+	authURL := c.AuthorizationURL(flow)
 
 	// Parse the redirect URI to extract the path
 	parsedRedirectURI, err := url.Parse(c.RedirectURI)
@@ -169,45 +252,109 @@ func (c *FortnoxClient) StartAuthorizationFlow() error {
 		return fmt.Errorf("invalid redirect URI: %v", err)
 	}
 
-	// Start a simple HTTP server to listen for the callback
-	server := &http.Server{Addr: parsedRedirectURI.Host}
+	// Listen before opening the browser so the callback cannot arrive before we are ready
+	listener, err := net.Listen("tcp", parsedRedirectURI.Host)
+	if err != nil {
+		return fmt.Errorf("could not listen on %s: %v", parsedRedirectURI.Host, err)
+	}
+
+	// Use a dedicated mux so that repeated flows do not register handlers on http.DefaultServeMux
+	result := make(chan error, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc(parsedRedirectURI.Path, c.callbackHandler(flow, result))
+	server := &http.Server{Handler: mux}
+
+	log.Printf("Listening on %s for the authorization code...", c.RedirectURI)
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			finishFlow(result, fmt.Errorf("callback server failed: %v", err))
+		}
+	}()
+
+	// Open the browser with the authorization URL, or let the user open it manually
+	if err := OpenBrowser(authURL); err != nil {
+		log.Printf("Could not open a browser (%v). Open this URL to authorize the integration:\n%s", err, authURL)
+	}
+
+	timer := time.NewTimer(c.authTimeout())
+	defer timer.Stop()
 
-	http.HandleFunc(parsedRedirectURI.Path, func(w http.ResponseWriter, r *http.Request) {
+	var flowErr error
+	select {
+	case flowErr = <-result:
+	case <-timer.C:
+		flowErr = fmt.Errorf("authorization timed out after %s", c.authTimeout())
+	}
+
+	// Create a context with a timeout to shutdown the server
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil && flowErr == nil {
+		flowErr = fmt.Errorf("server Shutdown Failed:%+v", err)
+	}
+
+	if flowErr == nil {
+		log.Println("Authorization successful")
+	}
+	return flowErr
+}
+
+// callbackHandler handles the redirect from Fortnox and reports the outcome of the flow on result
+func (c *FortnoxClient) callbackHandler(flow *AuthFlow, result chan<- error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
 		query := r.URL.Query()
-		code := query.Get("code")
-		stateReceived := query.Get("state")
 
-		if state != stateReceived {
-			http.Error(w, "state does not match", http.StatusBadRequest)
+		// A request with the wrong state is not from our flow; reject it and keep waiting
+		if query.Get("state") != flow.State {
+			renderAuthPage(w, http.StatusBadRequest, "Authorization failed", "The state parameter does not match. Start the authorization again from the integration.")
 			return
 		}
 
-		err := c.ExchangeAuthorizationCode(code)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("failed to exchange authorization code: %v", err), http.StatusInternalServerError)
+		if e := query.Get("error"); e != "" {
+			renderAuthPage(w, http.StatusForbidden, "Authorization denied", fmt.Sprintf("Fortnox returned %s: %s", e, query.Get("error_description")))
+			finishFlow(result, fmt.Errorf("authorization denied: %s %s", e, query.Get("error_description")))
 			return
 		}
 
-		fmt.Fprintf(w, "Authorization successful! You can close this window.")
-		c.AuthDone <- true
-	})
-
-	fmt.Printf("Listening on %s for the authorization code...\n", c.RedirectURI)
-	go func() {
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Could not listen on %s: %v\n", c.RedirectURI, err)
+		err := c.ExchangeAuthorizationCodeContext(r.Context(), query.Get("code"), flow.CodeVerifier)
+		if err != nil {
+			renderAuthPage(w, http.StatusInternalServerError, "Authorization failed", fmt.Sprintf("Failed to exchange authorization code: %v", err))
+			finishFlow(result, fmt.Errorf("failed to exchange authorization code: %w", err))
+			return
 		}
-	}()
 
-	<-c.AuthDone
-	fmt.Println("Authorization successful, signal authDone channel")
+		renderAuthPage(w, http.StatusOK, "Authorization successful", "You can close this window.")
+		finishFlow(result, nil)
+	}
+}
+
+func (c *FortnoxClient) authTimeout() time.Duration {
+	if c.AuthTimeout <= 0 {
+		return defaultAuthTimeout
+	}
+	return c.AuthTimeout
+}
 
-	// Create a context with a timeout to shutdown the server
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	if err := server.Shutdown(ctx); err != nil {
-		return fmt.Errorf("server Shutdown Failed:%+v", err)
+// finishFlow reports the outcome of a flow without blocking if it has already finished
+func finishFlow(result chan<- error, err error) {
+	select {
+	case result <- err:
+	default:
 	}
+}
 
-	return nil
+var authPage = template.Must(template.New("auth").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.Title}}</title></head>
+<body style="font-family: sans-serif; margin: 3em;">
+<h1>{{.Title}}</h1>
+<p>{{.Message}}</p>
+</body>
+</html>
+`))
+
+func renderAuthPage(w http.ResponseWriter, status int, title, message string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	authPage.Execute(w, struct{ Title, Message string }{title, message})
 }
@@ -0,0 +1,90 @@
+package fortnox
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestParseAuthorizationResponse(t *testing.T) {
+	const state = "Zm9ydG5veC1zdGF0ZQ"
+
+	tests := []struct {
+		name    string
+		input   string
+		want    string
+		wantErr string
+	}{
+		{"redirect url", "http://localhost:8080/callback?code=abc123&state=" + state, "abc123", ""},
+		{"redirect url with whitespace", "  http://localhost:8080/callback?state=" + state + "&code=abc123\n", "abc123", ""},
+		{"query only", "code=abc123&state=" + state, "abc123", ""},
+		{"bare code", "abc123\n", "abc123", ""},
+		{"escaped code", "http://localhost:8080/callback?code=a%2Bb%2Fc&state=" + state, "a+b/c", ""},
+		{"state mismatch", "http://localhost:8080/callback?code=abc123&state=other", "", "state does not match"},
+		{"missing state", "http://localhost:8080/callback?code=abc123", "", "state does not match"},
+		{"access denied", "http://localhost:8080/callback?error=access_denied&error_description=The+user+denied+access&state=" + state, "", "authorization denied: access_denied The user denied access"},
+		{"missing code", "http://localhost:8080/callback?code=&state=" + state, "", "no code in redirect URL"},
+		{"empty", " \n", "", "no authorization code given"},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseAuthorizationResponse(tt.input, state)
+		if tt.wantErr != "" {
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("%s: ParseAuthorizationResponse = %q, %v, want error %q", tt.name, got, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s: ParseAuthorizationResponse = %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestCodeChallenge(t *testing.T) {
+	// The example in RFC 7636, appendix B
+	if got := codeChallenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"); got != "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM" {
+		t.Errorf("codeChallenge = %q, want the RFC 7636 value", got)
+	}
+}
+
+func TestAuthorizationURL(t *testing.T) {
+	c := &FortnoxClient{ClientID: "client", RedirectURI: "http://localhost:8080/callback", Scopes: "invoice customer", UsePKCE: true}
+
+	flow, err := c.NewAuthFlow()
+	if err != nil {
+		t.Fatalf("NewAuthFlow: %v", err)
+	}
+	other, err := c.NewAuthFlow()
+	if err != nil {
+		t.Fatalf("NewAuthFlow: %v", err)
+	}
+	if flow.State == other.State || flow.CodeVerifier == other.CodeVerifier {
+		t.Error("two flows share their state or code verifier")
+	}
+	// RFC 7636 requires a verifier of 43 to 128 characters
+	if n := len(flow.CodeVerifier); n < 43 || n > 128 {
+		t.Errorf("code verifier has %d characters", n)
+	}
+
+	u, err := url.Parse(c.AuthorizationURL(flow))
+	if err != nil {
+		t.Fatalf("AuthorizationURL: %v", err)
+	}
+	params := u.Query()
+	if params.Get("state") != flow.State || params.Get("code_challenge") != codeChallenge(flow.CodeVerifier) || params.Get("code_challenge_method") != "S256" {
+		t.Errorf("AuthorizationURL parameters = %v", params)
+	}
+	if strings.Contains(u.RawQuery, flow.CodeVerifier) {
+		t.Error("AuthorizationURL contains the code verifier")
+	}
+
+	c.UsePKCE = false
+	flow, err = c.NewAuthFlow()
+	if err != nil {
+		t.Fatalf("NewAuthFlow: %v", err)
+	}
+	if u, err := url.Parse(c.AuthorizationURL(flow)); err != nil || u.Query().Has("code_challenge") || flow.CodeVerifier != "" {
+		t.Errorf("AuthorizationURL without PKCE = %v, %v", u, err)
+	}
+}
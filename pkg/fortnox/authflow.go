@@ -0,0 +1,66 @@
+package fortnox
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+)
+
+// AuthFlow holds the values of a single authorization attempt that must be kept
+// from building the authorization URL until the returned code is exchanged
+type AuthFlow struct {
+	State        string
+	CodeVerifier string // Empty when PKCE is not used
+}
+
+// NewAuthFlow starts a new authorization attempt with a random state and,
+// if UsePKCE is set, a random PKCE code verifier
+func (c *FortnoxClient) NewAuthFlow() (*AuthFlow, error) {
+	state, err := randomString(24)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate state: %v", err)
+	}
+	flow := &AuthFlow{State: state}
+
+	if c.UsePKCE {
+		flow.CodeVerifier, err = randomString(32)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate code verifier: %v", err)
+		}
+	}
+
+	return flow, nil
+}
+
+// AuthorizationURL returns the URL the user opens to authorize the integration for the given flow
+func (c *FortnoxClient) AuthorizationURL(flow *AuthFlow) string {
+	params := url.Values{}
+	params.Set("client_id", c.ClientID)
+	params.Set("redirect_uri", c.RedirectURI)
+	params.Set("scope", c.Scopes)
+	params.Set("state", flow.State)
+	params.Set("response_type", "code")
+	params.Set("access_type", "offline")
+	if flow.CodeVerifier != "" {
+		params.Set("code_challenge", codeChallenge(flow.CodeVerifier))
+		params.Set("code_challenge_method", "S256")
+	}
+	return authorizationEndpoint + "?" + params.Encode()
+}
+
+// codeChallenge derives the S256 PKCE code challenge from a code verifier
+func codeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// randomString returns n cryptographically random bytes encoded as URL-safe base64
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
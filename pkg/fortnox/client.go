@@ -1,75 +1,126 @@
 package fortnox
 
 import (
-	"fmt"
+	"context"
 	"io"
 	"net/http"
 	"strings"
-	"sync"
 	"time"
+
+	"fortnox_dynamics_integration/pkg/retry"
 )
 
-var rateLimitMutex sync.Mutex
-var lastRequestTime time.Time
+// defaultRequestTimeout bounds a single HTTP round trip to the Fortnox API
+const defaultRequestTimeout = 60 * time.Second
 
 // makeAPIRequest sends an HTTP request to the Fortnox API with the specified method, endpoint, and body.
-// It handles rate limiting, access token refreshing, and retries for HTTP 429 (Too Many Requests) responses.
+// It handles rate limiting, access token refreshing, and retries according to RetryPolicy.
+// Rate limiting goes through the client's RateLimiter, so concurrent callers only wait for
+// a free slot and may otherwise have requests in flight at the same time.
+// Each attempt is bounded by RequestTimeout, and the whole call stops when ctx is done.
 // The function returns the response body as a byte slice and an error if any occurred.
-func (c *FortnoxClient) makeAPIRequest(method, endpoint string, body []byte) ([]byte, error) {
-	rateLimitMutex.Lock()
-	defer rateLimitMutex.Unlock()
-
-	// Fortnox rate limit handling: 25 requests per 5 seconds
-	if time.Since(lastRequestTime) < 200*time.Millisecond {
-		time.Sleep(200*time.Millisecond - time.Since(lastRequestTime))
+func (c *FortnoxClient) makeAPIRequest(ctx context.Context, method, endpoint string, body []byte) ([]byte, error) {
+	token, err := c.validToken(ctx)
+	if err != nil {
+		return nil, err
 	}
-	lastRequestTime = time.Now()
 
-	if time.Now().After(c.ExpiresAt) {
-		if err := c.RefreshAccessToken(); err != nil {
-			return nil, err
+	client := &http.Client{}
+	var respBody []byte
+	var statusCode int
+
+	// Every attempt builds a new http.Request, so the body is sent in full each time
+	err = c.RetryPolicy.Do(ctx, method != http.MethodPost, func(ctx context.Context) (int, http.Header, error) {
+		if c.RateLimiter != nil {
+			if err := c.RateLimiter.Wait(ctx); err != nil {
+				return 0, nil, err
+			}
+		}
+
+		var header http.Header
+		var err error
+		statusCode, header, respBody, err = c.doRequest(ctx, client, token, method, endpoint, body)
+		if err != nil {
+			return 0, nil, err
 		}
-	}
 
-	req, err := http.NewRequest(method, c.APIBaseURL+endpoint, strings.NewReader(string(body)))
+		if c.RateLimiter != nil {
+			c.RateLimiter.Update(header)
+			if after, ok := retry.RetryAfter(header); ok && statusCode == http.StatusTooManyRequests {
+				c.RateLimiter.Pause(after)
+			}
+		}
+		return statusCode, header, nil
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	req.Header.Add("Authorization", "Bearer "+c.AccessToken)
+	if statusCode != http.StatusOK && statusCode != http.StatusCreated {
+		return nil, newAPIError(statusCode, respBody)
+	}
+
+	return respBody, nil
+}
+
+// doRequest performs a single attempt of an API request, bounded by RequestTimeout
+func (c *FortnoxClient) doRequest(ctx context.Context, client *http.Client, token, method, endpoint string, body []byte) (int, http.Header, []byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.requestTimeout())
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, method, c.APIBaseURL+endpoint, strings.NewReader(string(body)))
+	if err != nil {
+		return 0, nil, nil, err
+	}
+
+	req.Header.Add("Authorization", "Bearer "+token)
 	req.Header.Add("Content-Type", "application/json")
 	req.Header.Add("Accept", "application/json")
 
-	client := &http.Client{}
-	var resp *http.Response
-	var respErr error
-	backoff := time.Millisecond * 100
-	maxRetries := 5
-
-	for retries := 0; retries < maxRetries; retries++ {
-		resp, respErr = client.Do(req)
-		if respErr != nil {
-			return nil, respErr
-		}
-		if resp.StatusCode != http.StatusTooManyRequests {
-			break
-		}
-		time.Sleep(backoff)
-		backoff *= 2
-	}
-	if resp == nil {
-		return nil, fmt.Errorf("failed to get a response after %d retries", maxRetries)
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, nil, nil, err
 	}
 	defer resp.Body.Close()
 
 	respBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, err
+		return 0, nil, nil, err
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected status code: %d, body: %s", resp.StatusCode, string(respBody))
+	return resp.StatusCode, resp.Header, respBody, nil
+}
+
+// validToken returns an access token that has not expired, refreshing it first if needed.
+// Fortnox refresh tokens can only be used once, so concurrent callers share a single refresh.
+func (c *FortnoxClient) validToken(ctx context.Context) (string, error) {
+	c.tokenMu.Lock()
+	defer c.tokenMu.Unlock()
+
+	if time.Now().After(c.ExpiresAt) {
+		if err := c.RefreshAccessTokenContext(ctx); err != nil {
+			return "", err
+		}
 	}
+	return c.AccessToken, nil
+}
 
-	return respBody, nil
+func (c *FortnoxClient) requestTimeout() time.Duration {
+	if c.RequestTimeout <= 0 {
+		return defaultRequestTimeout
+	}
+	return c.RequestTimeout
+}
+
+// sleepContext sleeps for d, returning early with the context error if ctx is done first
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
 }
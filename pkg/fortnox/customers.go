@@ -0,0 +1,166 @@
+package fortnox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+)
+
+// Filter keys accepted by FetchCustomers and FetchCustomersPage
+const (
+	CustomerFilterStatus             = "filter" // CustomerStatusActive or CustomerStatusInactive
+	CustomerFilterCustomerNumber     = "customernumber"
+	CustomerFilterName               = "name"
+	CustomerFilterOrganisationNumber = "organisationnumber"
+	CustomerFilterEmail              = "email"
+	CustomerFilterPhone              = "phone"
+	CustomerFilterZipCode            = "zipcode"
+	CustomerFilterCity               = "city"
+	CustomerFilterGLN                = "gln"
+	CustomerFilterLastModified       = "lastmodified" // YYYY-MM-DD HH:MM
+	CustomerFilterSortBy             = "sortby"       // For example customernumber or name
+	CustomerFilterSortOrder          = "sortorder"    // ascending or descending
+)
+
+// Values of CustomerFilterStatus
+const (
+	CustomerStatusActive   = "active"
+	CustomerStatusInactive = "inactive"
+)
+
+// Values of Customer.Type and Customer.VATType
+const (
+	CustomerTypeCompany = "COMPANY"
+	CustomerTypePrivate = "PRIVATE"
+
+	VATTypeSweden              = "SEVAT"
+	VATTypeSwedenReverseCharge = "SEREVERSEDVAT"
+	VATTypeEUReverseCharge     = "EUREVERSEDVAT"
+	VATTypeEU                  = "EUVAT"
+	VATTypeExport              = "EXPORT"
+)
+
+// customersPageLimit is the largest page the Fortnox API returns
+const customersPageLimit = 500
+
+// FetchCustomers fetches customers from the Fortnox API based on the provided filters,
+// keyed by the CustomerFilter constants, for example {CustomerFilterStatus: CustomerStatusActive}.
+// All pages are fetched, 500 customers at a time. The list endpoint only returns the
+// address, contact and identity fields; use FetchCustomer for the complete customer.
+func (c *FortnoxClient) FetchCustomers(filters map[string]string) ([]Customer, error) {
+	return c.FetchCustomersContext(context.Background(), filters)
+}
+
+// FetchCustomersContext is like FetchCustomers but stops fetching further pages when ctx is done
+func (c *FortnoxClient) FetchCustomersContext(ctx context.Context, filters map[string]string) ([]Customer, error) {
+	var allCustomers []Customer
+	page := 1
+
+	for {
+		customersResponse, err := c.FetchCustomersPageContext(ctx, filters, page, customersPageLimit)
+		if err != nil {
+			return nil, err
+		}
+
+		allCustomers = append(allCustomers, customersResponse.Customers...)
+
+		if page >= customersResponse.MetaInformation.TotalPages {
+			break
+		}
+		page++
+	}
+
+	return allCustomers, nil
+}
+
+// FetchCustomersPage fetches a single page of customers, for callers that page through
+// the customers themselves. Pages are numbered from 1 and limit is at most 500.
+// MetaInformation in the response holds the total number of pages and customers.
+func (c *FortnoxClient) FetchCustomersPage(filters map[string]string, page, limit int) (*CustomersResponse, error) {
+	return c.FetchCustomersPageContext(context.Background(), filters, page, limit)
+}
+
+// FetchCustomersPageContext is like FetchCustomersPage but carries a context
+func (c *FortnoxClient) FetchCustomersPageContext(ctx context.Context, filters map[string]string, page, limit int) (*CustomersResponse, error) {
+	query := fmt.Sprintf("limit=%d&page=%d", limit, page)
+	for key, value := range filters {
+		query += fmt.Sprintf("&%s=%s", key, url.QueryEscape(value))
+	}
+	endpoint := fmt.Sprintf("/customers?%s", query)
+	respBody, err := c.makeAPIRequest(ctx, "GET", endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var customersResponse CustomersResponse
+	if err := json.Unmarshal(respBody, &customersResponse); err != nil {
+		return nil, err
+	}
+	return &customersResponse, nil
+}
+
+// FetchCustomer fetches a single customer by customer number.
+// A customer that does not exist gives an APIError for which NotFound is true.
+func (c *FortnoxClient) FetchCustomer(customerNumber string) (*Customer, error) {
+	return c.FetchCustomerContext(context.Background(), customerNumber)
+}
+
+// FetchCustomerContext is like FetchCustomer but carries a context
+func (c *FortnoxClient) FetchCustomerContext(ctx context.Context, customerNumber string) (*Customer, error) {
+	endpoint := fmt.Sprintf("/customers/%s", url.PathEscape(customerNumber))
+	respBody, err := c.makeAPIRequest(ctx, "GET", endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var customerResponse CustomerResponse
+	if err := json.Unmarshal(respBody, &customerResponse); err != nil {
+		return nil, err
+	}
+	return &customerResponse.Customer, nil
+}
+
+// CreateCustomer creates a customer in Fortnox and returns it as saved. Fields left empty
+// are not sent, so Fortnox fills in its defaults; a CustomerNumber is assigned if none is given.
+func (c *FortnoxClient) CreateCustomer(customer Customer) (*Customer, error) {
+	return c.CreateCustomerContext(context.Background(), customer)
+}
+
+// CreateCustomerContext is like CreateCustomer but carries a context
+func (c *FortnoxClient) CreateCustomerContext(ctx context.Context, customer Customer) (*Customer, error) {
+	return c.saveCustomer(ctx, "POST", "/customers", customer)
+}
+
+// UpdateCustomer updates a customer in Fortnox and returns it as saved. Only the fields set
+// in customer are changed; the others keep their values in Fortnox.
+func (c *FortnoxClient) UpdateCustomer(customerNumber string, customer Customer) (*Customer, error) {
+	return c.UpdateCustomerContext(context.Background(), customerNumber, customer)
+}
+
+// UpdateCustomerContext is like UpdateCustomer but carries a context
+func (c *FortnoxClient) UpdateCustomerContext(ctx context.Context, customerNumber string, customer Customer) (*Customer, error) {
+	endpoint := fmt.Sprintf("/customers/%s", url.PathEscape(customerNumber))
+	return c.saveCustomer(ctx, "PUT", endpoint, customer)
+}
+
+// saveCustomer sends a customer to Fortnox and decodes the saved customer from the response
+func (c *FortnoxClient) saveCustomer(ctx context.Context, method, endpoint string, customer Customer) (*Customer, error) {
+	// @url is read-only and would be rejected
+	customer.URL = ""
+	body, err := json.Marshal(CustomerResponse{Customer: customer})
+	if err != nil {
+		return nil, err
+	}
+
+	respBody, err := c.makeAPIRequest(ctx, method, endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+
+	var customerResponse CustomerResponse
+	if err := json.Unmarshal(respBody, &customerResponse); err != nil {
+		return nil, err
+	}
+	return &customerResponse.Customer, nil
+}
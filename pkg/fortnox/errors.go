@@ -0,0 +1,58 @@
+package fortnox
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// APIError is returned when the Fortnox API answers with an error status.
+// Use errors.As to inspect it.
+type APIError struct {
+	StatusCode int
+	Code       int    // ErrorInformation.code, a Fortnox specific error code
+	Message    string // ErrorInformation.message
+	Body       string // Raw response body, for errors without ErrorInformation
+}
+
+func (e *APIError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("fortnox: status %d, code %d: %s", e.StatusCode, e.Code, e.Message)
+	}
+	return fmt.Sprintf("fortnox: unexpected status code: %d, body: %s", e.StatusCode, e.Body)
+}
+
+// NotFound reports whether the requested resource does not exist
+func (e *APIError) NotFound() bool {
+	return e.StatusCode == http.StatusNotFound
+}
+
+// RateLimited reports whether the request was rejected by the Fortnox rate limit
+func (e *APIError) RateLimited() bool {
+	return e.StatusCode == http.StatusTooManyRequests
+}
+
+// Temporary reports whether the same request may succeed if sent again later
+func (e *APIError) Temporary() bool {
+	return e.RateLimited() || e.StatusCode >= http.StatusInternalServerError
+}
+
+// newAPIError builds an APIError from an error response, reading ErrorInformation if present
+func newAPIError(statusCode int, body []byte) *APIError {
+	apiErr := &APIError{StatusCode: statusCode, Body: string(body)}
+
+	var errorResponse struct {
+		ErrorInformation struct {
+			Message string      `json:"message"`
+			Code    json.Number `json:"code"`
+		} `json:"ErrorInformation"`
+	}
+	if json.Unmarshal(body, &errorResponse) == nil {
+		apiErr.Message = errorResponse.ErrorInformation.Message
+		if code, err := errorResponse.ErrorInformation.Code.Int64(); err == nil {
+			apiErr.Code = int(code)
+		}
+	}
+
+	return apiErr
+}
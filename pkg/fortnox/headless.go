@@ -0,0 +1,123 @@
+package fortnox
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// StartHeadlessAuthorizationFlow authorizes the client without a browser or callback server.
+// It prints the authorization URL to out and reads the redirect URL that the browser
+// ended up on, or just the code from it, from in. The code is then exchanged for tokens.
+// The flow fails if nothing is read within AuthTimeout.
+func (c *FortnoxClient) StartHeadlessAuthorizationFlow(in io.Reader, out io.Writer) error {
+	flow, err := c.NewAuthFlow()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "Open this URL in a browser on any machine and authorize the integration:\n\n%s\n\n", c.AuthorizationURL(flow))
+	fmt.Fprint(out, "Paste the URL you were redirected to (or just the code): ")
+
+	type readResult struct {
+		line string
+		err  error
+	}
+	read := make(chan readResult, 1)
+	go func() {
+		line, err := bufio.NewReader(in).ReadString('\n')
+		read <- readResult{line, err}
+	}()
+
+	var line string
+	select {
+	case r := <-read:
+		if r.err != nil && (r.err != io.EOF || r.line == "") {
+			return fmt.Errorf("failed to read authorization response: %v", r.err)
+		}
+		line = r.line
+	case <-time.After(c.authTimeout()):
+		return fmt.Errorf("authorization timed out after %s", c.authTimeout())
+	}
+
+	code, err := ParseAuthorizationResponse(line, flow.State)
+	if err != nil {
+		return err
+	}
+
+	if err := c.ExchangeAuthorizationCodeWithVerifier(code, flow.CodeVerifier); err != nil {
+		return fmt.Errorf("failed to exchange authorization code: %w", err)
+	}
+
+	fmt.Fprintln(out, "Authorization successful")
+	return nil
+}
+
+// ParseAuthorizationResponse extracts the authorization code from the pasted input,
+// which is either the full redirect URL or the bare code. When a redirect URL is given,
+// its state must match the expected state and an error returned by Fortnox is reported.
+func ParseAuthorizationResponse(input, expectedState string) (string, error) {
+	input = strings.TrimSpace(input)
+	if input == "" {
+		return "", fmt.Errorf("no authorization code given")
+	}
+
+	if !strings.Contains(input, "code=") && !strings.Contains(input, "error=") {
+		return input, nil
+	}
+
+	query := input
+	if u, err := url.Parse(input); err == nil && u.RawQuery != "" {
+		query = u.RawQuery
+	}
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return "", fmt.Errorf("invalid redirect URL: %v", err)
+	}
+
+	if e := values.Get("error"); e != "" {
+		return "", fmt.Errorf("authorization denied: %s %s", e, values.Get("error_description"))
+	}
+	if expectedState != "" && values.Get("state") != expectedState {
+		return "", fmt.Errorf("state does not match")
+	}
+
+	code := values.Get("code")
+	if code == "" {
+		return "", fmt.Errorf("no code in redirect URL")
+	}
+	return code, nil
+}
+
+// HasDesktop reports whether a browser can be expected to open on this machine
+func HasDesktop() bool {
+	switch runtime.GOOS {
+	case "darwin", "windows":
+		return true
+	default:
+		return os.Getenv("DISPLAY") != "" || os.Getenv("WAYLAND_DISPLAY") != ""
+	}
+}
+
+// OpenBrowser opens url in the default browser of the current platform
+func OpenBrowser(url string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", url)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", url)
+	default:
+		if !HasDesktop() {
+			return fmt.Errorf("no desktop session available")
+		}
+		cmd = exec.Command("xdg-open", url)
+	}
+	return cmd.Start()
+}
@@ -0,0 +1,130 @@
+package fortnox
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// Fortnox allows 25 requests per 5 seconds per access token
+	defaultRateLimit       = 25
+	defaultRateLimitPeriod = 5 * time.Second
+)
+
+// RateLimiter is a token bucket shared by all requests made through a FortnoxClient.
+// Requests wait only for a free token, not for each other, so several can be in flight at once.
+type RateLimiter struct {
+	mu          sync.Mutex
+	capacity    float64
+	rate        float64 // Tokens added per second
+	tokens      float64 // May be negative when waiters have reserved future tokens
+	last        time.Time
+	pausedUntil time.Time
+}
+
+// NewRateLimiter creates a limiter allowing requests per period, with bursts of up to requests
+func NewRateLimiter(requests int, period time.Duration) *RateLimiter {
+	if requests <= 0 {
+		requests = defaultRateLimit
+	}
+	if period <= 0 {
+		period = defaultRateLimitPeriod
+	}
+	return &RateLimiter{
+		capacity: float64(requests),
+		rate:     float64(requests) / period.Seconds(),
+		tokens:   float64(requests),
+		last:     time.Now(),
+	}
+}
+
+// refill adds the tokens accrued since the last call. The caller must hold l.mu.
+func (l *RateLimiter) refill(now time.Time) {
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.capacity {
+		l.tokens = l.capacity
+	}
+	l.last = now
+}
+
+// Wait blocks until a request may be sent or ctx is done
+func (l *RateLimiter) Wait(ctx context.Context) error {
+	l.mu.Lock()
+	now := time.Now()
+	l.refill(now)
+
+	// Reserve a token now and sleep until it has been earned
+	l.tokens--
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	if pause := l.pausedUntil.Sub(now); pause > wait {
+		wait = pause
+	}
+	l.mu.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+	if err := sleepContext(ctx, wait); err != nil {
+		// Give the reserved token back to the other waiters
+		l.mu.Lock()
+		l.tokens++
+		l.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Pause stops all requests for d, for example after Fortnox answered 429
+func (l *RateLimiter) Pause(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if until := time.Now().Add(d); until.After(l.pausedUntil) {
+		l.pausedUntil = until
+	}
+}
+
+// Update adapts the bucket to the rate limit headers of a Fortnox response.
+// If Fortnox reports fewer remaining requests than the bucket holds, for example
+// because another integration uses the same token, the bucket is drained to match,
+// and when nothing remains requests are paused until the reported reset.
+func (l *RateLimiter) Update(header http.Header) {
+	remaining, ok := headerInt(header, "X-RateLimit-Remaining", "X-Rate-Limit-Remaining")
+	if !ok {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refill(time.Now())
+	if float64(remaining) < l.tokens {
+		l.tokens = float64(remaining)
+	}
+
+	if remaining == 0 {
+		if reset, ok := headerInt(header, "X-RateLimit-Reset", "X-Rate-Limit-Reset"); ok && reset > 0 {
+			if until := time.Now().Add(time.Duration(reset) * time.Second); until.After(l.pausedUntil) {
+				l.pausedUntil = until
+			}
+		}
+	}
+}
+
+// headerInt returns the first of the named headers that holds an integer
+func headerInt(header http.Header, names ...string) (int, bool) {
+	for _, name := range names {
+		if v := header.Get(name); v != "" {
+			if n, err := strconv.Atoi(v); err == nil {
+				return n, true
+			}
+		}
+	}
+	return 0, false
+}
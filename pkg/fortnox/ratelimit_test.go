@@ -0,0 +1,97 @@
+package fortnox
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterBurstThenWait(t *testing.T) {
+	l := NewRateLimiter(3, 300*time.Millisecond)
+	ctx := context.Background()
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := l.Wait(ctx); err != nil {
+			t.Fatalf("Wait %d: %v", i, err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("burst of 3 took %v, want no wait", elapsed)
+	}
+
+	// The fourth request waits for one token, a third of the period
+	if err := l.Wait(ctx); err != nil {
+		t.Fatalf("Wait: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond {
+		t.Errorf("fourth request after %v, want about 100ms", elapsed)
+	}
+}
+
+func TestRateLimiterCancelReturnsToken(t *testing.T) {
+	l := NewRateLimiter(1, time.Hour)
+	if err := l.Wait(context.Background()); err != nil {
+		t.Fatalf("Wait: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := l.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Wait = %v, want the context error", err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.tokens < -0.01 || l.tokens > 0.01 {
+		t.Errorf("tokens = %v after a cancelled wait, want 0", l.tokens)
+	}
+}
+
+func TestRateLimiterUpdate(t *testing.T) {
+	tests := []struct {
+		name       string
+		header     http.Header
+		wantTokens float64
+		wantPause  bool
+	}{
+		{"no headers", http.Header{}, 25, false},
+		{"more remaining than the bucket holds", http.Header{"X-Ratelimit-Remaining": {"100"}}, 25, false},
+		{"fewer remaining", http.Header{"X-Ratelimit-Remaining": {"4"}}, 4, false},
+		{"alternative header", http.Header{"X-Rate-Limit-Remaining": {"2"}}, 2, false},
+		{"nothing remaining", http.Header{"X-Ratelimit-Remaining": {"0"}, "X-Ratelimit-Reset": {"3"}}, 0, true},
+		{"nothing remaining without reset", http.Header{"X-Ratelimit-Remaining": {"0"}}, 0, false},
+	}
+
+	for _, tt := range tests {
+		l := NewRateLimiter(25, time.Hour)
+		l.Update(tt.header)
+
+		l.mu.Lock()
+		tokens, paused := l.tokens, l.pausedUntil.After(time.Now().Add(2*time.Second))
+		l.mu.Unlock()
+
+		if tokens < tt.wantTokens-0.01 || tokens > tt.wantTokens+0.01 {
+			t.Errorf("%s: tokens = %v, want %v", tt.name, tokens, tt.wantTokens)
+		}
+		if paused != tt.wantPause {
+			t.Errorf("%s: paused = %v, want %v", tt.name, paused, tt.wantPause)
+		}
+	}
+}
+
+func TestRateLimiterPause(t *testing.T) {
+	l := NewRateLimiter(25, time.Second)
+	l.Pause(50 * time.Millisecond)
+	l.Pause(time.Millisecond) // A shorter pause does not cut the longer one short
+
+	start := time.Now()
+	if err := l.Wait(context.Background()); err != nil {
+		t.Fatalf("Wait: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("Wait returned after %v, want the 50ms pause", elapsed)
+	}
+}
@@ -0,0 +1,218 @@
+package fortnox
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultTokenFile = "fortnox_tokens.json"
+
+// ErrNoTokens is returned by a TokenStore when no tokens have been saved yet
+var ErrNoTokens = errors.New("no saved tokens")
+
+// Tokens is the OAuth token set persisted between runs
+type Tokens struct {
+	AccessToken  string    `json:"access_token"`
+	RefreshToken string    `json:"refresh_token"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+// TokenStore persists the Fortnox OAuth tokens so that the refresh token survives restarts
+type TokenStore interface {
+	Load() (*Tokens, error)
+	Save(tokens *Tokens) error
+}
+
+// NewTokenStoreFromEnv creates the token store selected by FORTNOX_TOKEN_STORE.
+// Supported values are "file" (default), "encrypted" and "memory".
+// FORTNOX_TOKEN_FILE sets the file path for the file based stores, and the encrypted
+// store reads its key from FORTNOX_TOKEN_KEY or from the file named by FORTNOX_TOKEN_KEY_FILE.
+func NewTokenStoreFromEnv() (TokenStore, error) {
+	path := os.Getenv("FORTNOX_TOKEN_FILE")
+	if path == "" {
+		path = defaultTokenFile
+	}
+
+	switch kind := os.Getenv("FORTNOX_TOKEN_STORE"); kind {
+	case "", "file":
+		return &FileTokenStore{Path: path}, nil
+	case "encrypted":
+		key := []byte(os.Getenv("FORTNOX_TOKEN_KEY"))
+		if keyFile := os.Getenv("FORTNOX_TOKEN_KEY_FILE"); keyFile != "" {
+			data, err := os.ReadFile(keyFile)
+			if err != nil {
+				return nil, fmt.Errorf("error reading token key file: %v", err)
+			}
+			key = []byte(strings.TrimSpace(string(data)))
+		}
+		if len(key) == 0 {
+			return nil, fmt.Errorf("FORTNOX_TOKEN_KEY or FORTNOX_TOKEN_KEY_FILE is required for the encrypted token store")
+		}
+		return NewEncryptedFileTokenStore(path, key), nil
+	case "memory":
+		return &MemoryTokenStore{}, nil
+	default:
+		return nil, fmt.Errorf("unknown FORTNOX_TOKEN_STORE %q", kind)
+	}
+}
+
+// FileTokenStore stores tokens as plain JSON in a file readable only by the owner
+type FileTokenStore struct {
+	Path string
+}
+
+func (s *FileTokenStore) Load() (*Tokens, error) {
+	data, err := os.ReadFile(s.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNoTokens
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeTokens(data)
+}
+
+func (s *FileTokenStore) Save(tokens *Tokens) error {
+	data, err := json.Marshal(tokens)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.Path, data)
+}
+
+// EncryptedFileTokenStore stores tokens in a file encrypted with AES-256-GCM
+type EncryptedFileTokenStore struct {
+	Path string
+	key  [32]byte
+}
+
+// NewEncryptedFileTokenStore creates an encrypted token store.
+// The AES key is derived from the given secret with SHA-256, so any secret length can be used.
+func NewEncryptedFileTokenStore(path string, secret []byte) *EncryptedFileTokenStore {
+	return &EncryptedFileTokenStore{Path: path, key: sha256.Sum256(secret)}
+}
+
+func (s *EncryptedFileTokenStore) Load() (*Tokens, error) {
+	data, err := os.ReadFile(s.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNoTokens
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := s.cipher()
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, fmt.Errorf("encrypted token file %s is truncated", s.Path)
+	}
+
+	nonce, ciphertext := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting token file %s: %v", s.Path, err)
+	}
+	return decodeTokens(plaintext)
+}
+
+func (s *EncryptedFileTokenStore) Save(tokens *Tokens) error {
+	plaintext, err := json.Marshal(tokens)
+	if err != nil {
+		return err
+	}
+
+	gcm, err := s.cipher()
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(s.Path, gcm.Seal(nonce, nonce, plaintext, nil))
+}
+
+func (s *EncryptedFileTokenStore) cipher() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(s.key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// MemoryTokenStore keeps tokens in memory only, which is useful for tests
+type MemoryTokenStore struct {
+	mu     sync.Mutex
+	tokens *Tokens
+}
+
+func (s *MemoryTokenStore) Load() (*Tokens, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.tokens == nil {
+		return nil, ErrNoTokens
+	}
+	tokens := *s.tokens
+	return &tokens, nil
+}
+
+func (s *MemoryTokenStore) Save(tokens *Tokens) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	saved := *tokens
+	s.tokens = &saved
+	return nil
+}
+
+// writeFileAtomic replaces the file at path with data, readable only by the owner. The data is
+// written to a temporary file that is renamed over path, so an interrupted write never destroys
+// the saved refresh token, which Fortnox accepts only once.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("error creating temporary token file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing token file: %v", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing token file: %v", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing token file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error writing token file: %v", err)
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+func decodeTokens(data []byte) (*Tokens, error) {
+	var tokens Tokens
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, err
+	}
+	return &tokens, nil
+}
@@ -0,0 +1,49 @@
+package fortnox
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileTokenStores(t *testing.T) {
+	tokens := &Tokens{AccessToken: "access", RefreshToken: "refresh", ExpiresAt: time.Date(2024, 5, 2, 13, 45, 0, 0, time.UTC)}
+
+	for name, newStore := range map[string]func(path string) TokenStore{
+		"file":      func(path string) TokenStore { return &FileTokenStore{Path: path} },
+		"encrypted": func(path string) TokenStore { return NewEncryptedFileTokenStore(path, []byte("secret")) },
+	} {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "fortnox_tokens.json")
+
+		// An existing file readable by others is replaced by one readable only by the owner
+		if err := os.WriteFile(path, []byte("{}"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		store := newStore(path)
+		if err := store.Save(tokens); err != nil {
+			t.Fatalf("%s: Save: %v", name, err)
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mode := info.Mode().Perm(); mode != 0600 {
+			t.Errorf("%s: file mode = %v, want 0600", name, mode)
+		}
+		if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+			t.Errorf("%s: directory holds %d files, want only the token file", name, len(entries))
+		}
+
+		loaded, err := newStore(path).Load()
+		if err != nil {
+			t.Fatalf("%s: Load: %v", name, err)
+		}
+		if *loaded != *tokens {
+			t.Errorf("%s: Load = %+v, want %+v", name, loaded, tokens)
+		}
+	}
+}
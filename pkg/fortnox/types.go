@@ -1,5 +1,11 @@
 package fortnox
 
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
 type MetaInformation struct {
 	TotalResources int `json:"@TotalResources"`
 	TotalPages     int `json:"@TotalPages"`
@@ -11,6 +17,8 @@ type InvoicesResponse struct {
 	Invoices        []Invoice       `json:"Invoices"`
 }
 
+// Invoice holds the fields returned by the invoice list. The remaining fields and the rows
+// are only filled in for an invoice fetched with FetchInvoice.
 type Invoice struct {
 	Balance        float64 `json:"Balance"`
 	Booked         bool    `json:"Booked"`
@@ -21,4 +29,176 @@ type Invoice struct {
 	DueDate        string  `json:"DueDate"`
 	InvoiceDate    string  `json:"InvoiceDate"`
 	Total          float64 `json:"Total"`
+
+	AdministrationFee         float64      `json:"AdministrationFee,omitempty"`
+	Address1                  string       `json:"Address1,omitempty"`
+	Address2                  string       `json:"Address2,omitempty"`
+	City                      string       `json:"City,omitempty"`
+	Comments                  string       `json:"Comments,omitempty"`
+	CostCenter                string       `json:"CostCenter,omitempty"`
+	Country                   string       `json:"Country,omitempty"`
+	Currency                  string       `json:"Currency,omitempty"`
+	CurrencyRate              float64      `json:"CurrencyRate,omitempty"`
+	CurrencyUnit              float64      `json:"CurrencyUnit,omitempty"`
+	DeliveryAddress1          string       `json:"DeliveryAddress1,omitempty"`
+	DeliveryAddress2          string       `json:"DeliveryAddress2,omitempty"`
+	DeliveryCity              string       `json:"DeliveryCity,omitempty"`
+	DeliveryCountry           string       `json:"DeliveryCountry,omitempty"`
+	DeliveryDate              string       `json:"DeliveryDate,omitempty"`
+	DeliveryName              string       `json:"DeliveryName,omitempty"`
+	DeliveryZipCode           string       `json:"DeliveryZipCode,omitempty"`
+	ExternalInvoiceReference1 string       `json:"ExternalInvoiceReference1,omitempty"`
+	ExternalInvoiceReference2 string       `json:"ExternalInvoiceReference2,omitempty"`
+	FinalPayDate              string       `json:"FinalPayDate,omitempty"`
+	Freight                   float64      `json:"Freight,omitempty"`
+	Gross                     float64      `json:"Gross,omitempty"`
+	InvoiceRows               []InvoiceRow `json:"InvoiceRows,omitempty"`
+	InvoiceType               string       `json:"InvoiceType,omitempty"`
+	Language                  string       `json:"Language,omitempty"`
+	Net                       float64      `json:"Net,omitempty"`
+	OCR                       string       `json:"OCR,omitempty"`
+	OrganisationNumber        string       `json:"OrganisationNumber,omitempty"`
+	OurReference              string       `json:"OurReference,omitempty"`
+	Phone1                    string       `json:"Phone1,omitempty"`
+	Phone2                    string       `json:"Phone2,omitempty"`
+	PriceList                 string       `json:"PriceList,omitempty"`
+	Project                   string       `json:"Project,omitempty"`
+	Remarks                   string       `json:"Remarks,omitempty"`
+	RoundOff                  float64      `json:"RoundOff,omitempty"`
+	Sent                      bool         `json:"Sent,omitempty"`
+	TermsOfDelivery           string       `json:"TermsOfDelivery,omitempty"`
+	TermsOfPayment            string       `json:"TermsOfPayment,omitempty"`
+	TotalToPay                float64      `json:"TotalToPay,omitempty"`
+	TotalVAT                  float64      `json:"TotalVAT,omitempty"`
+	VATIncluded               bool         `json:"VATIncluded,omitempty"`
+	WayOfDelivery             string       `json:"WayOfDelivery,omitempty"`
+	YourOrderNumber           string       `json:"YourOrderNumber,omitempty"`
+	YourReference             string       `json:"YourReference,omitempty"`
+	ZipCode                   string       `json:"ZipCode,omitempty"`
+}
+
+type InvoiceResponse struct {
+	Invoice Invoice `json:"Invoice"`
+}
+
+// InvoiceRow is a line of an invoice. RowId identifies the row within its invoice.
+type InvoiceRow struct {
+	AccountNumber     int     `json:"AccountNumber,omitempty"`
+	ArticleNumber     string  `json:"ArticleNumber,omitempty"`
+	CostCenter        string  `json:"CostCenter,omitempty"`
+	DeliveredQuantity Decimal `json:"DeliveredQuantity,omitempty"`
+	Description       string  `json:"Description,omitempty"`
+	Discount          float64 `json:"Discount,omitempty"`
+	DiscountType      string  `json:"DiscountType,omitempty"`
+	Price             float64 `json:"Price,omitempty"`
+	PriceExcludingVAT float64 `json:"PriceExcludingVAT,omitempty"`
+	Project           string  `json:"Project,omitempty"`
+	RowId             int     `json:"RowId,omitempty"`
+	Total             float64 `json:"Total,omitempty"`
+	TotalExcludingVAT float64 `json:"TotalExcludingVAT,omitempty"`
+	Unit              string  `json:"Unit,omitempty"`
+	VAT               float64 `json:"VAT,omitempty"`
+}
+
+// Decimal is a number that Fortnox may send either as a JSON number or as a string,
+// as it does for the quantity of an invoice row ("2.00")
+type Decimal float64
+
+func (d *Decimal) UnmarshalJSON(data []byte) error {
+	s := strings.Trim(string(data), `"`)
+	if s == "" || s == "null" {
+		*d = 0
+		return nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return fmt.Errorf("invalid decimal %s", data)
+	}
+	*d = Decimal(f)
+	return nil
+}
+
+type CustomersResponse struct {
+	MetaInformation MetaInformation `json:"MetaInformation"`
+	Customers       []Customer      `json:"Customers"`
+}
+
+type CustomerResponse struct {
+	Customer Customer `json:"Customer"`
+}
+
+type Customer struct {
+	URL                      string                `json:"@url,omitempty"`
+	Active                   *bool                 `json:"Active,omitempty"`
+	Address1                 string                `json:"Address1,omitempty"`
+	Address2                 string                `json:"Address2,omitempty"`
+	City                     string                `json:"City,omitempty"`
+	Comments                 string                `json:"Comments,omitempty"`
+	CostCenter               string                `json:"CostCenter,omitempty"`
+	Country                  string                `json:"Country,omitempty"`
+	CountryCode              string                `json:"CountryCode,omitempty"`
+	Currency                 string                `json:"Currency,omitempty"`
+	CustomerNumber           string                `json:"CustomerNumber,omitempty"`
+	DefaultDeliveryTypes     *DefaultDeliveryTypes `json:"DefaultDeliveryTypes,omitempty"`
+	DefaultTemplates         *DefaultTemplates     `json:"DefaultTemplates,omitempty"`
+	DeliveryAddress1         string                `json:"DeliveryAddress1,omitempty"`
+	DeliveryAddress2         string                `json:"DeliveryAddress2,omitempty"`
+	DeliveryCity             string                `json:"DeliveryCity,omitempty"`
+	DeliveryCountry          string                `json:"DeliveryCountry,omitempty"`
+	DeliveryCountryCode      string                `json:"DeliveryCountryCode,omitempty"`
+	DeliveryFax              string                `json:"DeliveryFax,omitempty"`
+	DeliveryName             string                `json:"DeliveryName,omitempty"`
+	DeliveryPhone1           string                `json:"DeliveryPhone1,omitempty"`
+	DeliveryPhone2           string                `json:"DeliveryPhone2,omitempty"`
+	DeliveryZipCode          string                `json:"DeliveryZipCode,omitempty"`
+	Email                    string                `json:"Email,omitempty"`
+	EmailInvoice             string                `json:"EmailInvoice,omitempty"`
+	EmailInvoiceBCC          string                `json:"EmailInvoiceBCC,omitempty"`
+	EmailInvoiceCC           string                `json:"EmailInvoiceCC,omitempty"`
+	EmailOffer               string                `json:"EmailOffer,omitempty"`
+	EmailOfferBCC            string                `json:"EmailOfferBCC,omitempty"`
+	EmailOfferCC             string                `json:"EmailOfferCC,omitempty"`
+	EmailOrder               string                `json:"EmailOrder,omitempty"`
+	EmailOrderBCC            string                `json:"EmailOrderBCC,omitempty"`
+	EmailOrderCC             string                `json:"EmailOrderCC,omitempty"`
+	ExternalReference        string                `json:"ExternalReference,omitempty"`
+	Fax                      string                `json:"Fax,omitempty"`
+	GLN                      string                `json:"GLN,omitempty"`
+	GLNDelivery              string                `json:"GLNDelivery,omitempty"`
+	InvoiceAdministrationFee *float64              `json:"InvoiceAdministrationFee,omitempty"`
+	InvoiceDiscount          *float64              `json:"InvoiceDiscount,omitempty"`
+	InvoiceFreight           *float64              `json:"InvoiceFreight,omitempty"`
+	InvoiceRemark            string                `json:"InvoiceRemark,omitempty"`
+	Name                     string                `json:"Name,omitempty"`
+	OrganisationNumber       string                `json:"OrganisationNumber,omitempty"`
+	OurReference             string                `json:"OurReference,omitempty"`
+	Phone                    string                `json:"Phone,omitempty"`
+	Phone1                   string                `json:"Phone1,omitempty"`
+	Phone2                   string                `json:"Phone2,omitempty"`
+	PriceList                string                `json:"PriceList,omitempty"`
+	Project                  string                `json:"Project,omitempty"`
+	SalesAccount             string                `json:"SalesAccount,omitempty"`
+	ShowPriceVATIncluded     *bool                 `json:"ShowPriceVATIncluded,omitempty"`
+	TermsOfDelivery          string                `json:"TermsOfDelivery,omitempty"`
+	TermsOfPayment           string                `json:"TermsOfPayment,omitempty"`
+	Type                     string                `json:"Type,omitempty"`
+	VATNumber                string                `json:"VATNumber,omitempty"`
+	VATType                  string                `json:"VATType,omitempty"`
+	WayOfDelivery            string                `json:"WayOfDelivery,omitempty"`
+	WWW                      string                `json:"WWW,omitempty"`
+	YourReference            string                `json:"YourReference,omitempty"`
+	ZipCode                  string                `json:"ZipCode,omitempty"`
+}
+
+type DefaultDeliveryTypes struct {
+	Invoice string `json:"Invoice,omitempty"`
+	Offer   string `json:"Offer,omitempty"`
+	Order   string `json:"Order,omitempty"`
+}
+
+type DefaultTemplates struct {
+	CashInvoice string `json:"CashInvoice,omitempty"`
+	Invoice     string `json:"Invoice,omitempty"`
+	Offer       string `json:"Offer,omitempty"`
+	Order       string `json:"Order,omitempty"`
 }
\ No newline at end of file
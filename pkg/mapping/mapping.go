@@ -0,0 +1,704 @@
+// Package mapping describes how Fortnox invoices, and optionally customers, are written to
+// Dynamics 365 tables. A mapping is loaded from a YAML or JSON file, so that each deployment
+// can map to its own Dynamics schema without code changes. Source fields are named as in the
+// Fortnox API.
+//
+//	entity_set: cr123_invoices
+//	id_column: cr123_invoiceid
+//	key_column: cr123_documentnumber
+//	customer:
+//	  navigation_property: cr123_customer
+//	  entity_set: accounts
+//	  id_column: accountid
+//	  match_column: accountnumber
+//	  source: CustomerNumber
+//	pdf:
+//	  column: cr123_pdf
+//	  filename: "{DocumentNumber}.pdf"
+//	columns:
+//	  - name: cr123_name
+//	    format: "{InvoiceDate}-{DocumentNumber}"
+//	  - name: cr123_documentnumber
+//	    source: DocumentNumber
+//	  - name: cr123_total
+//	    source: Total
+//	    type: number
+//	    update: true
+//	    refresh_pdf: true
+//	  - name: cr123_customername
+//	    source: CustomerName
+//	    transform: [trim]
+//	  - name: cr123_source
+//	    value: 100000001
+//	    type: integer
+//	accounts:
+//	  entity_set: accounts
+//	  id_column: accountid
+//	  key_column: accountnumber
+//	  columns:
+//	    - name: accountnumber
+//	      source: CustomerNumber
+//	    - name: name
+//	      source: Name
+//	      update: true
+//	    - name: cr123_orgnumber
+//	      source: OrganisationNumber
+//	      update: true
+//	rows:
+//	  entity_set: cr123_invoicerows
+//	  id_column: cr123_invoicerowid
+//	  key_column: cr123_rowid
+//	  parent: cr123_invoice
+//	  parent_column: _cr123_invoice_value
+//	  columns:
+//	    - name: cr123_rowid
+//	      source: RowId
+//	      type: integer
+//	    - name: cr123_articlenumber
+//	      source: ArticleNumber
+//	      update: true
+//	    - name: cr123_quantity
+//	      source: DeliveredQuantity
+//	      type: number
+//	      update: true
+package mapping
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"gopkg.in/yaml.v3"
+
+	"fortnox_dynamics_integration/pkg/fortnox"
+)
+
+// Column types, deciding how a value is converted before it is written and how it is compared
+const (
+	TypeString  = "string"
+	TypeNumber  = "number"  // Decimal or currency, compared with a tolerance of half an öre
+	TypeInteger = "integer" // Whole number or option set value
+	TypeBoolean = "boolean"
+	TypeDate    = "date" // Date only, written as YYYY-MM-DD
+)
+
+// Transforms applied to a value, in order, before it is converted to the column type
+const (
+	TransformTrim  = "trim"
+	TransformUpper = "upper"
+	TransformLower = "lower"
+)
+
+// Table describes a Dynamics 365 table and how each of its columns is filled from a Fortnox record
+type Table struct {
+	EntitySet string   `yaml:"entity_set" json:"entity_set"` // For example new_fakturas
+	IDColumn  string   `yaml:"id_column" json:"id_column"`   // Primary key column, for example new_fakturaid
+	KeyColumn string   `yaml:"key_column" json:"key_column"` // Mapped column identifying the Fortnox record, used to find existing records and for upserts
+	Columns   []Column `yaml:"columns" json:"columns"`
+}
+
+// Mapping describes the invoice table, with its customer lookup, PDF column and rows, and the
+// account table written by the customer sync
+type Mapping struct {
+	Table    `yaml:",inline"`
+	Customer Lookup `yaml:"customer" json:"customer"`
+	PDF      PDF    `yaml:"pdf" json:"pdf"`
+	Rows     *Rows  `yaml:"rows,omitempty" json:"rows,omitempty"`         // Invoice rows, nil leaves them out
+	Accounts *Table `yaml:"accounts,omitempty" json:"accounts,omitempty"` // Fortnox customers, nil disables the customer sync
+}
+
+// Rows describes the child table that invoice rows are written to. Its columns are filled
+// from fortnox.InvoiceRow and its key column identifies a row within its invoice, normally RowId.
+type Rows struct {
+	Table        `yaml:",inline"`
+	Parent       string `yaml:"parent" json:"parent"`               // Navigation property from a row to its invoice, bound when a row is created
+	ParentColumn string `yaml:"parent_column" json:"parent_column"` // Lookup column of Parent, for example _cr123_invoice_value, used to find the rows of an invoice
+}
+
+// Lookup binds each record to a related record, for example the customer account
+type Lookup struct {
+	NavigationProperty string `yaml:"navigation_property" json:"navigation_property"` // Empty disables the lookup
+	EntitySet          string `yaml:"entity_set" json:"entity_set"`
+	IDColumn           string `yaml:"id_column" json:"id_column"`
+	MatchColumn        string `yaml:"match_column" json:"match_column"` // Column in EntitySet compared with Source
+	Source             string `yaml:"source" json:"source"`             // Fortnox invoice field
+}
+
+// PDF describes where the invoice PDF is uploaded
+type PDF struct {
+	Column   string `yaml:"column" json:"column"`     // File column, empty disables the upload
+	Filename string `yaml:"filename" json:"filename"` // Template, for example "{InvoiceDate}-{DocumentNumber}.pdf"
+}
+
+// Column describes how one column is filled. Exactly one of Source, Value and Format is set.
+type Column struct {
+	Name       string      `yaml:"name" json:"name"`
+	Source     string      `yaml:"source,omitempty" json:"source,omitempty"` // Fortnox field, for example DocumentNumber
+	Value      interface{} `yaml:"value,omitempty" json:"value,omitempty"`   // Constant value
+	Format     string      `yaml:"format,omitempty" json:"format,omitempty"` // Template with {Field} placeholders
+	Transform  []string    `yaml:"transform,omitempty" json:"transform,omitempty"`
+	Type       string      `yaml:"type,omitempty" json:"type,omitempty"`               // One of the Type constants, string if empty
+	Update     bool        `yaml:"update,omitempty" json:"update,omitempty"`           // Compared and updated after the record was created
+	RefreshPDF bool        `yaml:"refresh_pdf,omitempty" json:"refresh_pdf,omitempty"` // A change uploads the invoice PDF again
+}
+
+// Default returns the mapping used when no mapping file is configured
+func Default() *Mapping {
+	return &Mapping{
+		Table: Table{
+			EntitySet: "new_fakturas",
+			IDColumn:  "new_fakturaid",
+			KeyColumn: "new_documentnumber",
+			Columns: []Column{
+				{Name: "new_fakturanummer", Format: "{InvoiceDate}-{DocumentNumber}"},
+				{Name: "new_balance", Source: "Balance", Type: TypeNumber, Update: true},
+				{Name: "new_booked", Source: "Booked", Type: TypeBoolean, Update: true},
+				{Name: "new_cancelled", Source: "Cancelled", Type: TypeBoolean, Update: true},
+				{Name: "new_documentnumber", Source: "DocumentNumber"},
+				{Name: "new_duedate", Source: "DueDate", Type: TypeDate, Update: true, RefreshPDF: true},
+				{Name: "new_invoicedate", Source: "InvoiceDate", Type: TypeDate},
+				{Name: "new_total", Source: "Total", Type: TypeNumber, Update: true, RefreshPDF: true},
+				{Name: "new_distributor", Value: 100000001, Type: TypeInteger},
+			},
+		},
+		Customer: Lookup{
+			NavigationProperty: "new_customer_account",
+			EntitySet:          "accounts",
+			IDColumn:           "accountid",
+			MatchColumn:        "new_kundnummer",
+			Source:             "CustomerNumber",
+		},
+		PDF: PDF{
+			Column:   "new_invoicepdf",
+			Filename: "{InvoiceDate}-{DocumentNumber}.pdf",
+		},
+		Accounts: &Table{
+			EntitySet: "accounts",
+			IDColumn:  "accountid",
+			KeyColumn: "new_kundnummer",
+			Columns: []Column{
+				{Name: "new_kundnummer", Source: "CustomerNumber"},
+				{Name: "name", Source: "Name", Transform: []string{TransformTrim}, Update: true},
+				{Name: "address1_line1", Source: "Address1", Update: true},
+				{Name: "address1_line2", Source: "Address2", Update: true},
+				{Name: "address1_postalcode", Source: "ZipCode", Update: true},
+				{Name: "address1_city", Source: "City", Update: true},
+				{Name: "address1_country", Source: "Country", Update: true},
+				{Name: "emailaddress1", Source: "Email", Update: true},
+			},
+		},
+	}
+}
+
+// DefaultUnmappedAccountFields are Fortnox customer fields that the default accounts table
+// leaves out, as a standard Dynamics 365 account has no column for them. A mapping file
+// maps them to custom columns.
+var DefaultUnmappedAccountFields = []string{"OrganisationNumber"}
+
+// Source types of the tables, whose field names may be used as source and in templates
+var (
+	invoiceType  = reflect.TypeOf(fortnox.Invoice{})
+	rowType      = reflect.TypeOf(fortnox.InvoiceRow{})
+	customerType = reflect.TypeOf(fortnox.Customer{})
+)
+
+// Load reads and validates a mapping file. Files ending in .json are read as JSON, others as YAML.
+// Unknown keys are rejected, so that a misspelt option is not silently ignored.
+func Load(path string) (*Mapping, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var m Mapping
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&m)
+	} else {
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		err = dec.Decode(&m)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing mapping file %s: %v", path, err)
+	}
+
+	if err := m.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid mapping file %s: %w", path, err)
+	}
+	return &m, nil
+}
+
+// Validate checks that the mapping is complete and refers only to existing Fortnox fields,
+// known types and transforms. All problems are reported together.
+func (m *Mapping) Validate() error {
+	errs := m.Table.validate(invoiceType)
+	problem := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if c := m.Customer; c.NavigationProperty != "" {
+		if c.EntitySet == "" || c.IDColumn == "" || c.MatchColumn == "" || c.Source == "" {
+			problem("customer needs entity_set, id_column, match_column and source")
+		}
+		if c.Source != "" && !hasField(invoiceType, c.Source) {
+			problem("customer source %q is not a Fortnox invoice field", c.Source)
+		}
+	}
+
+	if m.PDF.Column != "" {
+		if m.PDF.Filename == "" {
+			problem("pdf needs a filename")
+		}
+		for _, field := range placeholders(m.PDF.Filename) {
+			if !hasField(invoiceType, field) {
+				problem("pdf filename refers to unknown Fortnox invoice field %q", field)
+			}
+		}
+	}
+
+	if r := m.Rows; r != nil {
+		for _, err := range r.validate(rowType) {
+			problem("rows: %v", err)
+		}
+		if r.Parent == "" || r.ParentColumn == "" {
+			problem("rows needs parent and parent_column")
+		}
+		if r.EntitySet != "" && r.EntitySet == m.EntitySet {
+			problem("rows must use another entity_set than the invoices")
+		}
+	}
+
+	if a := m.Accounts; a != nil {
+		for _, err := range a.validate(customerType) {
+			problem("accounts: %v", err)
+		}
+
+		// Accounts created by the customer sync must be found by the customer lookup of invoices
+		if c := m.Customer; c.NavigationProperty != "" && (a.EntitySet != c.EntitySet || a.IDColumn != c.IDColumn || a.KeyColumn != c.MatchColumn) {
+			problem("accounts must use the entity_set, id_column and match_column (as key_column) of the customer lookup")
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// validate checks the table against the fields of its Fortnox source type
+func (t *Table) validate(source reflect.Type) []error {
+	var errs []error
+	problem := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+	kind := describeType(source)
+
+	if t.EntitySet == "" {
+		problem("entity_set is required")
+	}
+	if t.IDColumn == "" {
+		problem("id_column is required")
+	}
+	if t.KeyColumn == "" {
+		problem("key_column is required")
+	} else if t.column(t.KeyColumn) == nil {
+		problem("key_column %q is not one of the mapped columns", t.KeyColumn)
+	}
+
+	if len(t.Columns) == 0 {
+		problem("at least one column is required")
+	}
+	seen := make(map[string]bool)
+	for i, c := range t.Columns {
+		name := c.Name
+		if name == "" {
+			problem("column %d has no name", i+1)
+			name = fmt.Sprintf("#%d", i+1)
+		} else if seen[name] {
+			problem("column %q is mapped twice", name)
+		}
+		seen[name] = true
+
+		sources := 0
+		if c.Source != "" {
+			sources++
+			if !hasField(source, c.Source) {
+				problem("column %q: source %q is not a Fortnox %s field", name, c.Source, kind)
+			}
+		}
+		if c.Value != nil {
+			sources++
+		}
+		if c.Format != "" {
+			sources++
+			for _, field := range placeholders(c.Format) {
+				if !hasField(source, field) {
+					problem("column %q: format refers to unknown Fortnox %s field %q", name, kind, field)
+				}
+			}
+		}
+		if sources != 1 {
+			problem("column %q needs exactly one of source, value and format", name)
+		}
+
+		for _, tr := range c.Transform {
+			switch tr {
+			case TransformTrim, TransformUpper, TransformLower:
+			default:
+				problem("column %q: unknown transform %q", name, tr)
+			}
+		}
+
+		switch c.Type {
+		case "", TypeString, TypeNumber, TypeInteger, TypeBoolean, TypeDate:
+		default:
+			problem("column %q: unknown type %q", name, c.Type)
+		}
+
+		// A constant must already be valid for its column type
+		if c.Value != nil {
+			if _, err := convert(c.Value, c.Type); err != nil {
+				problem("column %q: value: %v", name, err)
+			}
+		}
+		if c.RefreshPDF && source != invoiceType {
+			problem("column %q: refresh_pdf only applies to invoices", name)
+		}
+	}
+
+	return errs
+}
+
+// describeType names a Fortnox source type in messages, for example "invoice row"
+func describeType(t reflect.Type) string {
+	var name []rune
+	for i, r := range t.Name() {
+		if i > 0 && unicode.IsUpper(r) {
+			name = append(name, ' ')
+		}
+		name = append(name, unicode.ToLower(r))
+	}
+	return string(name)
+}
+
+// MapsField reports whether any column is filled from the Fortnox field, as source or in a format
+func (t *Table) MapsField(name string) bool {
+	for _, c := range t.Columns {
+		if c.Source == name {
+			return true
+		}
+		for _, field := range placeholders(c.Format) {
+			if field == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// column returns the mapped column with the given name, or nil
+func (t *Table) column(name string) *Column {
+	for i := range t.Columns {
+		if t.Columns[i].Name == name {
+			return &t.Columns[i]
+		}
+	}
+	return nil
+}
+
+// Apply maps a Fortnox record, such as a fortnox.Invoice, to the columns of a record.
+// Lookups are not included.
+func (t *Table) Apply(source interface{}) (map[string]interface{}, error) {
+	record := make(map[string]interface{}, len(t.Columns))
+	for _, c := range t.Columns {
+		var value interface{}
+		switch {
+		case c.Source != "":
+			value, _ = field(source, c.Source)
+		case c.Format != "":
+			value = format(c.Format, source)
+		default:
+			value = c.Value
+		}
+
+		// An unset optional Fortnox field clears the column, whatever its type
+		if value == nil {
+			record[c.Name] = nil
+			continue
+		}
+
+		if len(c.Transform) > 0 {
+			s := fmt.Sprint(value)
+			for _, t := range c.Transform {
+				switch t {
+				case TransformTrim:
+					s = strings.TrimSpace(s)
+				case TransformUpper:
+					s = strings.ToUpper(s)
+				case TransformLower:
+					s = strings.ToLower(s)
+				}
+			}
+			value = s
+		}
+
+		converted, err := convert(value, c.Type)
+		if err != nil {
+			return nil, fmt.Errorf("column %s: %v", c.Name, err)
+		}
+		record[c.Name] = converted
+	}
+	return record, nil
+}
+
+// Key returns the value of the key column in a record made by Apply
+func (t *Table) Key(record map[string]interface{}) interface{} {
+	return record[t.KeyColumn]
+}
+
+// KeyString returns the key column of a record made by Apply or read from Dynamics 365 as text,
+// so that the two can be matched although Dynamics returns whole numbers as decimals
+func (t *Table) KeyString(record map[string]interface{}) string {
+	value := record[t.KeyColumn]
+	if c := t.column(t.KeyColumn); c != nil {
+		if converted, err := convert(value, c.Type); err == nil {
+			value = converted
+		}
+	}
+	return text(value)
+}
+
+// CustomerValue returns the value looked up in the customer match column
+func (m *Mapping) CustomerValue(invoice fortnox.Invoice) interface{} {
+	value, _ := field(invoice, m.Customer.Source)
+	return value
+}
+
+// PDFFilename returns the filename of the uploaded invoice PDF
+func (m *Mapping) PDFFilename(invoice fortnox.Invoice) string {
+	return format(m.PDF.Filename, invoice)
+}
+
+// UpdateColumns returns the columns compared and updated after a record was created
+func (t *Table) UpdateColumns() []string {
+	var columns []string
+	for _, c := range t.Columns {
+		if c.Update {
+			columns = append(columns, c.Name)
+		}
+	}
+	return columns
+}
+
+// Diff compares a record read from Dynamics 365 with a freshly mapped one and returns
+// the update columns that differ, keyed by column name with the updated value
+func (t *Table) Diff(existing, updated map[string]interface{}) map[string]interface{} {
+	changes := make(map[string]interface{})
+	for _, c := range t.Columns {
+		if c.Update && !same(c.Type, existing[c.Name], updated[c.Name]) {
+			changes[c.Name] = updated[c.Name]
+		}
+	}
+	return changes
+}
+
+// RefreshesPDF reports whether any of the changed columns means the PDF must be uploaded again
+func (m *Mapping) RefreshesPDF(changes map[string]interface{}) bool {
+	for _, c := range m.Columns {
+		if _, changed := changes[c.Name]; changed && c.RefreshPDF {
+			return true
+		}
+	}
+	return false
+}
+
+// same compares two column values of the given type. Dynamics 365 may return date-only
+// columns with a time part, amounts with rounding noise and empty text as null.
+func same(typ string, a, b interface{}) bool {
+	if typ == "" || typ == TypeString {
+		return text(a) == text(b)
+	}
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+
+	switch typ {
+	case TypeNumber, TypeInteger:
+		x, errX := toFloat(a)
+		y, errY := toFloat(b)
+		if errX != nil || errY != nil {
+			return false
+		}
+		if typ == TypeInteger {
+			return x == y
+		}
+		return math.Abs(x-y) < 0.005
+	case TypeDate:
+		return datePart(fmt.Sprint(a)) == datePart(fmt.Sprint(b))
+	default:
+		return fmt.Sprint(a) == fmt.Sprint(b)
+	}
+}
+
+// text formats a text column value, with null as the empty string
+func text(value interface{}) string {
+	if value == nil {
+		return ""
+	}
+	return fmt.Sprint(value)
+}
+
+// convert converts a value to the column type
+func convert(value interface{}, typ string) (interface{}, error) {
+	switch typ {
+	case TypeNumber:
+		return toFloat(value)
+	case TypeInteger:
+		f, err := toFloat(value)
+		if err != nil {
+			return nil, err
+		}
+		if f != math.Trunc(f) {
+			return nil, fmt.Errorf("%v is not a whole number", value)
+		}
+		return int64(f), nil
+	case TypeBoolean:
+		switch v := value.(type) {
+		case bool:
+			return v, nil
+		case string:
+			return strconv.ParseBool(strings.TrimSpace(v))
+		}
+		return nil, fmt.Errorf("%v is not a boolean", value)
+	case TypeDate:
+		s := datePart(fmt.Sprint(value))
+		if s == "" {
+			return nil, nil
+		}
+		if _, err := time.Parse("2006-01-02", s); err != nil {
+			return nil, fmt.Errorf("%q is not a date", value)
+		}
+		return s, nil
+	default:
+		if value == nil {
+			return "", nil
+		}
+		if s, ok := value.(string); ok {
+			return s, nil
+		}
+		return fmt.Sprint(value), nil
+	}
+}
+
+func toFloat(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case float64:
+		return v, nil
+	case float32:
+		return float64(v), nil
+	case int:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case json.Number:
+		return v.Float64()
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(strings.ReplaceAll(v, ",", ".")), 64)
+		if err != nil {
+			return 0, fmt.Errorf("%q is not a number", v)
+		}
+		return f, nil
+	}
+	return 0, fmt.Errorf("%v is not a number", value)
+}
+
+// datePart returns the YYYY-MM-DD part of a date or date and time
+func datePart(s string) string {
+	if len(s) > 10 {
+		return s[:10]
+	}
+	return s
+}
+
+var placeholderPattern = regexp.MustCompile(`\{(\w+)\}`)
+
+// placeholders returns the field names used in a template
+func placeholders(template string) []string {
+	var fields []string
+	for _, match := range placeholderPattern.FindAllStringSubmatch(template, -1) {
+		fields = append(fields, match[1])
+	}
+	return fields
+}
+
+// format fills the {Field} placeholders of a template from a Fortnox record. Unset fields
+// are left empty.
+func format(template string, source interface{}) string {
+	return placeholderPattern.ReplaceAllStringFunc(template, func(placeholder string) string {
+		value, _ := field(source, placeholder[1:len(placeholder)-1])
+		return text(value)
+	})
+}
+
+// hasField reports whether name is a field of the Fortnox source type that can fill a column.
+// Nested records and lists, such as the invoice rows, cannot.
+func hasField(source reflect.Type, name string) bool {
+	i, ok := fieldIndex(source, name)
+	if !ok {
+		return false
+	}
+	t := source.Field(i).Type
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Struct, reflect.Slice, reflect.Map:
+		return false
+	}
+	return true
+}
+
+// field returns a field of a Fortnox record by its name in the Fortnox API
+func field(source interface{}, name string) (interface{}, bool) {
+	v := reflect.Indirect(reflect.ValueOf(source))
+	i, ok := fieldIndex(v.Type(), name)
+	if !ok {
+		return nil, false
+	}
+
+	// Optional Fortnox fields are pointers, and unset ones are returned as nil, which Apply
+	// writes as null
+	f := v.Field(i)
+	if f.Kind() == reflect.Pointer {
+		if f.IsNil() {
+			return nil, true
+		}
+		f = f.Elem()
+	}
+	// Named number types such as fortnox.Decimal are read as plain numbers
+	if f.Kind() == reflect.Float64 || f.Kind() == reflect.Float32 {
+		return f.Float(), true
+	}
+	return f.Interface(), true
+}
+
+// fieldIndex finds a struct field by its Go name or JSON name
+func fieldIndex(t reflect.Type, name string) (int, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if f.Name == name || tag == name {
+			return i, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,394 @@
+package mapping
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"fortnox_dynamics_integration/pkg/dynamics"
+	"fortnox_dynamics_integration/pkg/fortnox"
+)
+
+const yamlMapping = `
+entity_set: cr123_invoices
+id_column: cr123_invoiceid
+key_column: cr123_documentnumber
+customer:
+  navigation_property: cr123_customer
+  entity_set: accounts
+  id_column: accountid
+  match_column: accountnumber
+  source: CustomerNumber
+pdf:
+  column: cr123_pdf
+  filename: "{DocumentNumber}.pdf"
+columns:
+  - name: cr123_documentnumber
+    source: DocumentNumber
+  - name: cr123_total
+    source: Total
+    type: number
+    update: true
+    refresh_pdf: true
+`
+
+const jsonMapping = `{
+  "entity_set": "cr123_invoices",
+  "id_column": "cr123_invoiceid",
+  "key_column": "cr123_documentnumber",
+  "columns": [
+    {"name": "cr123_documentnumber", "source": "DocumentNumber"},
+    {"name": "cr123_total", "source": "Total", "type": "number", "update": true}
+  ]
+}`
+
+// writeMapping writes a mapping file to a temporary directory and returns its path
+func writeMapping(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		wantErr string
+	}{
+		{name: "yaml", file: "mapping.yaml", content: yamlMapping},
+		{name: "json", file: "mapping.json", content: jsonMapping},
+		{name: "unknown yaml key", file: "mapping.yml", content: yamlMapping + "colums: []\n", wantErr: "colums"},
+		{name: "unknown json key", file: "mapping.json", content: strings.Replace(jsonMapping, `"id_column"`, `"idcolumn"`, 1), wantErr: "idcolumn"},
+		{name: "invalid", file: "mapping.yaml", content: strings.Replace(yamlMapping, "source: Total", "source: Totl", 1), wantErr: `source "Totl" is not a Fortnox invoice field`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := Load(writeMapping(t, tt.file, tt.content))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Load error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Load: %v", err)
+			}
+			if m.EntitySet != "cr123_invoices" || m.KeyColumn != "cr123_documentnumber" || len(m.Columns) != 2 {
+				t.Errorf("Load = %+v", m)
+			}
+			if c := m.column("cr123_total"); c == nil || c.Type != TypeNumber || !c.Update {
+				t.Errorf("cr123_total = %+v", c)
+			}
+		})
+	}
+}
+
+func TestValidateReportsAllProblems(t *testing.T) {
+	m := &Mapping{
+		Table: Table{
+			EntitySet: "cr123_invoices",
+			KeyColumn: "cr123_missing",
+			Columns: []Column{
+				{Name: "cr123_total", Source: "Total", Type: "money"},
+				{Name: "cr123_total", Value: 1},
+				{Name: "cr123_both", Source: "Total", Format: "{Total}"},
+				{Name: "cr123_case", Source: "CustomerName", Transform: []string{"title"}},
+				{Name: "cr123_source", Value: "x", Type: TypeInteger},
+			},
+		},
+		PDF: PDF{Column: "cr123_pdf", Filename: "{Nope}.pdf"},
+	}
+
+	err := m.Validate()
+	if err == nil {
+		t.Fatal("Validate = nil, want errors")
+	}
+	for _, want := range []string{
+		"id_column is required",
+		`key_column "cr123_missing" is not one of the mapped columns`,
+		`column "cr123_total": unknown type "money"`,
+		`column "cr123_total" is mapped twice`,
+		`column "cr123_both" needs exactly one of source, value and format`,
+		`column "cr123_case": unknown transform "title"`,
+		`column "cr123_source": value: "x" is not a number`,
+		`pdf filename refers to unknown Fortnox invoice field "Nope"`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Validate error does not contain %q:\n%v", want, err)
+		}
+	}
+}
+
+func TestConvert(t *testing.T) {
+	tests := []struct {
+		value   interface{}
+		typ     string
+		want    interface{}
+		wantErr bool
+	}{
+		{value: "text", typ: "", want: "text"},
+		{value: 12, typ: TypeString, want: "12"},
+		{value: nil, typ: TypeString, want: ""},
+		{value: 1.25, typ: TypeNumber, want: 1.25},
+		{value: "1,5", typ: TypeNumber, want: 1.5},
+		{value: json.Number("2"), typ: TypeNumber, want: 2.0},
+		{value: "abc", typ: TypeNumber, wantErr: true},
+		{value: 100000001, typ: TypeInteger, want: int64(100000001)},
+		{value: 4.0, typ: TypeInteger, want: int64(4)},
+		{value: 4.5, typ: TypeInteger, wantErr: true},
+		{value: true, typ: TypeBoolean, want: true},
+		{value: " false ", typ: TypeBoolean, want: false},
+		{value: 1, typ: TypeBoolean, wantErr: true},
+		{value: "2024-01-31", typ: TypeDate, want: "2024-01-31"},
+		{value: "2024-01-31T00:00:00Z", typ: TypeDate, want: "2024-01-31"},
+		{value: "", typ: TypeDate, want: nil},
+		{value: "31/01/2024", typ: TypeDate, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s %v", tt.typ, tt.value), func(t *testing.T) {
+			got, err := convert(tt.value, tt.typ)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("convert = %#v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("convert: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("convert = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSame(t *testing.T) {
+	tests := []struct {
+		typ  string
+		a, b interface{}
+		want bool
+	}{
+		{typ: TypeNumber, a: 100.0, b: 100.004, want: true},
+		{typ: TypeNumber, a: 100.0, b: 99.996, want: true},
+		{typ: TypeNumber, a: 100.0, b: 100.006, want: false},
+		{typ: TypeNumber, a: nil, b: 0.0, want: false},
+		{typ: TypeInteger, a: 5.0, b: int64(5), want: true},
+		{typ: TypeInteger, a: 5.0, b: int64(6), want: false},
+		{typ: TypeDate, a: "2024-01-31T00:00:00Z", b: "2024-01-31", want: true},
+		{typ: TypeDate, a: "2024-01-31T00:00:00Z", b: "2024-02-01", want: false},
+		{typ: TypeString, a: nil, b: "", want: true},
+		{typ: "", a: "a", b: "b", want: false},
+		{typ: TypeBoolean, a: true, b: true, want: true},
+		{typ: TypeBoolean, a: nil, b: nil, want: true},
+	}
+
+	for _, tt := range tests {
+		if got := same(tt.typ, tt.a, tt.b); got != tt.want {
+			t.Errorf("same(%q, %#v, %#v) = %v, want %v", tt.typ, tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	m := Default()
+	invoice := fortnox.Invoice{DocumentNumber: "7", Balance: 100, Total: 100, DueDate: "2024-02-29", InvoiceDate: "2024-01-31"}
+	updated, err := m.Apply(invoice)
+	if err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+
+	existing := map[string]interface{}{
+		"new_balance":   100.001,
+		"new_booked":    false,
+		"new_cancelled": false,
+		"new_duedate":   "2024-02-29T00:00:00Z",
+		"new_total":     90.0,
+	}
+	changes := m.Diff(existing, updated)
+	if len(changes) != 1 || changes["new_total"] != 100.0 {
+		t.Errorf("Diff = %v, want only new_total", changes)
+	}
+	if !m.RefreshesPDF(changes) {
+		t.Error("RefreshesPDF = false for a changed total")
+	}
+}
+
+func TestKeyString(t *testing.T) {
+	rows := Table{KeyColumn: "cr123_rowid", Columns: []Column{{Name: "cr123_rowid", Source: "RowId", Type: TypeInteger}}}
+	mapped, err := rows.Apply(fortnox.InvoiceRow{RowId: 5})
+	if err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+
+	// Dynamics 365 returns whole numbers decoded from JSON as float64
+	fromDynamics := map[string]interface{}{"cr123_rowid": 5.0}
+	if got, want := rows.KeyString(fromDynamics), rows.KeyString(mapped); got != "5" || want != "5" {
+		t.Errorf("KeyString = %q and %q, want \"5\"", got, want)
+	}
+}
+
+// TestDefaultMatchesFixedInvoice checks that the default mapping writes the same body as
+// the fixed invoice mapping it replaced
+func TestDefaultMatchesFixedInvoice(t *testing.T) {
+	invoice := fortnox.Invoice{
+		Balance:        250.5,
+		Booked:         true,
+		CustomerNumber: "1001",
+		DocumentNumber: "4711",
+		DueDate:        "2024-02-29",
+		InvoiceDate:    "2024-01-31",
+		Total:          1250.75,
+	}
+
+	record, err := Default().Apply(invoice)
+	if err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	fixed := dynamics.DynamicsInvoice{
+		InvoiceNumber:  fmt.Sprintf("%s-%s", invoice.InvoiceDate, invoice.DocumentNumber),
+		Balance:        invoice.Balance,
+		Booked:         invoice.Booked,
+		Canceled:       invoice.Cancelled,
+		DocumentNumber: invoice.DocumentNumber,
+		DueDate:        invoice.DueDate,
+		InvoiceDate:    invoice.InvoiceDate,
+		Total:          invoice.Total,
+		Distributor:    100000001,
+	}
+
+	if got, want := jsonObject(t, record), jsonObject(t, fixed); !reflect.DeepEqual(got, want) {
+		t.Errorf("default mapping body = %v, want %v", got, want)
+	}
+}
+
+// jsonObject returns the JSON body of v decoded into a map, so that bodies can be compared
+func jsonObject(t *testing.T, v interface{}) map[string]interface{} {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var object map[string]interface{}
+	if err := json.Unmarshal(data, &object); err != nil {
+		t.Fatal(err)
+	}
+	return object
+}
+
+// optionalFields has an optional field of each kind, like the pointer fields of fortnox.Customer
+type optionalFields struct {
+	Name    *string
+	Amount  *float64
+	Count   *int
+	Active  *bool
+	Date    *string
+	Present string
+}
+
+func TestApplyNilPointers(t *testing.T) {
+	table := Table{
+		EntitySet: "records",
+		IDColumn:  "recordid",
+		KeyColumn: "key",
+		Columns: []Column{
+			{Name: "key", Source: "Present"},
+			{Name: "name", Source: "Name"},
+			{Name: "amount", Source: "Amount", Type: TypeNumber},
+			{Name: "count", Source: "Count", Type: TypeInteger},
+			{Name: "active", Source: "Active", Type: TypeBoolean},
+			{Name: "date", Source: "Date", Type: TypeDate},
+			{Name: "upper", Source: "Name", Transform: []string{TransformTrim, TransformUpper}},
+			{Name: "label", Format: "{Present}-{Name}"},
+		},
+	}
+
+	record, err := table.Apply(optionalFields{Present: "k"})
+	if err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	for _, column := range []string{"name", "amount", "count", "active", "date", "upper"} {
+		value, ok := record[column]
+		if !ok || value != nil {
+			t.Errorf("%s = %#v, want nil", column, value)
+		}
+	}
+	if got := record["label"]; got != "k-" {
+		t.Errorf("label = %#v, want %q", got, "k-")
+	}
+
+	name, amount, count, active, date := " x ", 1.5, 3, true, "2024-01-31T00:00:00"
+	record, err = table.Apply(&optionalFields{Name: &name, Amount: &amount, Count: &count, Active: &active, Date: &date, Present: "k"})
+	if err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	want := map[string]interface{}{
+		"key":    "k",
+		"name":   " x ",
+		"amount": 1.5,
+		"count":  int64(3),
+		"active": true,
+		"date":   "2024-01-31",
+		"upper":  "X",
+		"label":  "k- x ",
+	}
+	for column, value := range want {
+		if record[column] != value {
+			t.Errorf("%s = %#v, want %#v", column, record[column], value)
+		}
+	}
+}
+
+func TestApplyCustomerWithoutOptionalFields(t *testing.T) {
+	accounts := Table{
+		EntitySet: "accounts",
+		IDColumn:  "accountid",
+		KeyColumn: "accountnumber",
+		Columns: []Column{
+			{Name: "accountnumber", Source: "CustomerNumber"},
+			{Name: "active", Source: "Active", Type: TypeBoolean, Update: true},
+			{Name: "discount", Source: "InvoiceDiscount", Type: TypeNumber, Update: true},
+		},
+	}
+
+	record, err := accounts.Apply(fortnox.Customer{CustomerNumber: "10"})
+	if err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if record["active"] != nil || record["discount"] != nil {
+		t.Errorf("unset fields = %#v, %#v, want nil", record["active"], record["discount"])
+	}
+	if changes := accounts.Diff(map[string]interface{}{"active": nil, "discount": nil}, record); len(changes) != 0 {
+		t.Errorf("Diff = %v, want no changes", changes)
+	}
+}
+
+func TestDefaultAccounts(t *testing.T) {
+	accounts := Default().Accounts
+	record, err := accounts.Apply(fortnox.Customer{CustomerNumber: "1001", Name: " Kund AB ", Country: "Sverige", OrganisationNumber: "556677-8899"})
+	if err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if record["new_kundnummer"] != "1001" || record["name"] != "Kund AB" || record["address1_country"] != "Sverige" {
+		t.Errorf("account = %v", record)
+	}
+
+	for _, field := range DefaultUnmappedAccountFields {
+		if accounts.MapsField(field) {
+			t.Errorf("default accounts map %s, which DefaultUnmappedAccountFields lists as unmapped", field)
+		}
+	}
+	if !accounts.MapsField("CustomerNumber") {
+		t.Error("MapsField(CustomerNumber) = false")
+	}
+}
@@ -0,0 +1,198 @@
+package mapping
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"fortnox_dynamics_integration/pkg/dynamics"
+)
+
+// edmTypes lists the EDM types each column type may be written to
+var edmTypes = map[string][]string{
+	TypeString:  {"Edm.String"},
+	TypeNumber:  {"Edm.Decimal", "Edm.Double", "Edm.Int32", "Edm.Int64"},
+	TypeInteger: {"Edm.Int32", "Edm.Int64", "Edm.Int16"},
+	TypeBoolean: {"Edm.Boolean"},
+	TypeDate:    {"Edm.Date", "Edm.DateTimeOffset"},
+}
+
+// CheckSchema compares the invoice table with the Dynamics 365 schema: the entity set, the
+// type of every mapped column, constant choice values, the PDF column and the customer lookup.
+// optionSets holds the choice columns of the entity set, as returned by D365.FetchOptionSets.
+// All mismatches are reported together. The accounts table is checked separately.
+func (m *Mapping) CheckSchema(metadata *dynamics.Metadata, optionSets map[string][]dynamics.Option) error {
+	entityType := metadata.EntitySet(m.EntitySet)
+	if entityType == nil {
+		return fmt.Errorf("entity set %q does not exist", m.EntitySet)
+	}
+
+	errs := m.Table.checkColumns(entityType, optionSets)
+	problem := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if m.PDF.Column != "" && entityType.Property(m.PDF.Column) == nil {
+		problem("pdf column %q does not exist in %s", m.PDF.Column, entityType.Name)
+	}
+
+	if m.Customer.NavigationProperty != "" {
+		errs = append(errs, m.checkLookup(metadata, entityType)...)
+	}
+
+	return errors.Join(errs...)
+}
+
+// CheckSchema compares the table with the Dynamics 365 schema, like Mapping.CheckSchema
+func (t *Table) CheckSchema(metadata *dynamics.Metadata, optionSets map[string][]dynamics.Option) error {
+	entityType := metadata.EntitySet(t.EntitySet)
+	if entityType == nil {
+		return fmt.Errorf("entity set %q does not exist", t.EntitySet)
+	}
+	return errors.Join(t.checkColumns(entityType, optionSets)...)
+}
+
+// checkColumns checks the primary key and the mapped columns of the table
+func (t *Table) checkColumns(entityType *dynamics.EntityType, optionSets map[string][]dynamics.Option) []error {
+	var errs []error
+	problem := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if entityType.Property(t.IDColumn) == nil {
+		problem("id_column %q is not a column of %s", t.IDColumn, entityType.Name)
+	} else if len(entityType.Key) != 1 || entityType.Key[0] != t.IDColumn {
+		problem("id_column %q is not the primary key of %s (%s)", t.IDColumn, entityType.Name, strings.Join(entityType.Key, ", "))
+	}
+
+	for _, c := range t.Columns {
+		property := entityType.Property(c.Name)
+		if property == nil {
+			problem("column %q does not exist in %s", c.Name, entityType.Name)
+			continue
+		}
+
+		typ := c.Type
+		if typ == "" {
+			typ = TypeString
+		}
+		if !contains(edmTypes[typ], property.Type) {
+			problem("column %q is %s in Dynamics 365, which cannot hold a %s", c.Name, property.Type, typ)
+		}
+
+		if options, ok := optionSets[c.Name]; ok && c.Value != nil {
+			value, err := convert(c.Value, TypeInteger)
+			if err == nil && !hasOption(options, value.(int64)) {
+				problem("column %q: %v is not one of the choices %s", c.Name, c.Value, describeOptions(options))
+			}
+		}
+	}
+
+	return errs
+}
+
+// checkLookup checks that the customer lookup leads to the configured entity set
+// and that its match and ID columns exist there
+func (m *Mapping) checkLookup(metadata *dynamics.Metadata, entityType *dynamics.EntityType) []error {
+	lookup := m.Customer
+	navigation := entityType.NavigationProperty(lookup.NavigationProperty)
+	if navigation == nil {
+		return []error{fmt.Errorf("customer navigation_property %q does not exist in %s (names are case sensitive)", lookup.NavigationProperty, entityType.Name)}
+	}
+	if navigation.Collection() {
+		return []error{fmt.Errorf("customer navigation_property %q leads to many records and cannot be bound", lookup.NavigationProperty)}
+	}
+
+	target := metadata.EntitySet(lookup.EntitySet)
+	if target == nil {
+		return []error{fmt.Errorf("customer entity set %q does not exist", lookup.EntitySet)}
+	}
+
+	var errs []error
+	if target.Name != navigation.Target() {
+		errs = append(errs, fmt.Errorf("customer navigation_property %q leads to %s, not to %s", lookup.NavigationProperty, navigation.Target(), lookup.EntitySet))
+	}
+	if target.Property(lookup.IDColumn) == nil {
+		errs = append(errs, fmt.Errorf("customer id_column %q does not exist in %s", lookup.IDColumn, target.Name))
+	}
+	if target.Property(lookup.MatchColumn) == nil {
+		errs = append(errs, fmt.Errorf("customer match_column %q does not exist in %s", lookup.MatchColumn, target.Name))
+	}
+	return errs
+}
+
+// CheckRowsSchema compares the rows table with the Dynamics 365 schema, like CheckSchema, and
+// checks that its parent lookup leads to the invoice table. optionSets holds the choice columns
+// of the rows entity set.
+func (m *Mapping) CheckRowsSchema(metadata *dynamics.Metadata, optionSets map[string][]dynamics.Option) error {
+	rows := m.Rows
+	entityType := metadata.EntitySet(rows.EntitySet)
+	if entityType == nil {
+		return fmt.Errorf("entity set %q does not exist", rows.EntitySet)
+	}
+
+	errs := rows.checkColumns(entityType, optionSets)
+	problem := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	navigation := entityType.NavigationProperty(rows.Parent)
+	switch {
+	case navigation == nil:
+		problem("parent %q does not exist in %s (names are case sensitive)", rows.Parent, entityType.Name)
+	case navigation.Collection():
+		problem("parent %q leads to many records and cannot be bound", rows.Parent)
+	default:
+		if invoices := metadata.EntitySet(m.EntitySet); invoices != nil && invoices.Name != navigation.Target() {
+			problem("parent %q leads to %s, not to %s", rows.Parent, navigation.Target(), m.EntitySet)
+		}
+	}
+	if entityType.Property(rows.ParentColumn) == nil {
+		problem("parent_column %q does not exist in %s", rows.ParentColumn, entityType.Name)
+	}
+
+	return errors.Join(errs...)
+}
+
+// CheckAlternateKey checks that the key column is an alternate key of the entity set,
+// which upserts by document number require
+func (m *Mapping) CheckAlternateKey(metadata *dynamics.Metadata) error {
+	entityType := metadata.EntitySet(m.EntitySet)
+	if entityType == nil {
+		return fmt.Errorf("entity set %q does not exist", m.EntitySet)
+	}
+	if !entityType.HasAlternateKey(m.KeyColumn) {
+		return fmt.Errorf("key_column %q is not an alternate key of %s", m.KeyColumn, entityType.Name)
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func hasOption(options []dynamics.Option, value int64) bool {
+	for _, o := range options {
+		if int64(o.Value) == value {
+			return true
+		}
+	}
+	return false
+}
+
+// describeOptions lists choices as "100000000 (Direct), 100000001 (Partner)"
+func describeOptions(options []dynamics.Option) string {
+	values := make([]string, len(options))
+	for i, o := range options {
+		values[i] = fmt.Sprint(o.Value)
+		if o.Label != "" {
+			values[i] += fmt.Sprintf(" (%s)", o.Label)
+		}
+	}
+	return strings.Join(values, ", ")
+}
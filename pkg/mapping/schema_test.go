@@ -0,0 +1,226 @@
+package mapping
+
+import (
+	"strings"
+	"testing"
+
+	"fortnox_dynamics_integration/pkg/dynamics"
+)
+
+// schemaXML is a $metadata document with the tables of the default mapping and a rows table
+const schemaXML = `<?xml version="1.0" encoding="utf-8"?>
+<edmx:Edmx Version="4.0" xmlns:edmx="http://docs.oasis-open.org/odata/ns/edmx">
+  <edmx:DataServices>
+    <Schema Namespace="Microsoft.Dynamics.CRM" Alias="mscrm" xmlns="http://docs.oasis-open.org/odata/ns/edm">
+      <EntityType Name="crmbaseentity" Abstract="true" />
+      <EntityType Name="account" BaseType="mscrm.crmbaseentity">
+        <Key><PropertyRef Name="accountid" /></Key>
+        <Property Name="accountid" Type="Edm.Guid" />
+        <Property Name="name" Type="Edm.String" />
+        <Property Name="new_kundnummer" Type="Edm.String" />
+        <Property Name="address1_line1" Type="Edm.String" />
+        <Property Name="address1_line2" Type="Edm.String" />
+        <Property Name="address1_postalcode" Type="Edm.String" />
+        <Property Name="address1_city" Type="Edm.String" />
+        <Property Name="address1_country" Type="Edm.String" />
+        <Property Name="emailaddress1" Type="Edm.String" />
+      </EntityType>
+      <EntityType Name="new_faktura" BaseType="mscrm.crmbaseentity">
+        <Key><PropertyRef Name="new_fakturaid" /></Key>
+        <Property Name="new_fakturaid" Type="Edm.Guid" />
+        <Property Name="new_fakturanummer" Type="Edm.String" />
+        <Property Name="new_balance" Type="Edm.Decimal" />
+        <Property Name="new_booked" Type="Edm.Boolean" />
+        <Property Name="new_cancelled" Type="Edm.Boolean" />
+        <Property Name="new_documentnumber" Type="Edm.String" />
+        <Property Name="new_duedate" Type="Edm.Date" />
+        <Property Name="new_invoicedate" Type="Edm.DateTimeOffset" />
+        <Property Name="new_total" Type="Edm.Decimal" Scale="4" />
+        <Property Name="new_distributor" Type="Edm.Int32" />
+        <Property Name="new_invoicepdf" Type="Edm.Guid" />
+        <NavigationProperty Name="new_customer_account" Type="mscrm.account" />
+        <NavigationProperty Name="new_faktura_rows" Type="Collection(mscrm.new_fakturarad)" />
+      </EntityType>
+      <EntityType Name="new_fakturarad" BaseType="mscrm.crmbaseentity">
+        <Key><PropertyRef Name="new_fakturaradid" /></Key>
+        <Property Name="new_fakturaradid" Type="Edm.Guid" />
+        <Property Name="new_rowid" Type="Edm.Int32" />
+        <Property Name="new_description" Type="Edm.String" />
+        <Property Name="_new_faktura_value" Type="Edm.Guid" />
+        <NavigationProperty Name="new_faktura" Type="mscrm.new_faktura" />
+        <NavigationProperty Name="new_account" Type="mscrm.account" />
+      </EntityType>
+      <EntityContainer Name="System">
+        <EntitySet Name="accounts" EntityType="Microsoft.Dynamics.CRM.account" />
+        <EntitySet Name="new_fakturas" EntityType="Microsoft.Dynamics.CRM.new_faktura" />
+        <EntitySet Name="new_fakturarads" EntityType="Microsoft.Dynamics.CRM.new_fakturarad" />
+      </EntityContainer>
+    </Schema>
+  </edmx:DataServices>
+</edmx:Edmx>`
+
+// distributorOptions are the choices of new_distributor, as returned by D365.FetchOptionSets
+var distributorOptions = map[string][]dynamics.Option{
+	"new_distributor": {{Value: 100000000, Label: "Direct"}, {Value: 100000001, Label: "Partner"}},
+}
+
+func parseSchema(t *testing.T) *dynamics.Metadata {
+	t.Helper()
+	metadata, err := dynamics.ParseMetadata([]byte(schemaXML))
+	if err != nil {
+		t.Fatalf("ParseMetadata: %v", err)
+	}
+	return metadata
+}
+
+func testRows() *Rows {
+	return &Rows{
+		Table: Table{
+			EntitySet: "new_fakturarads",
+			IDColumn:  "new_fakturaradid",
+			KeyColumn: "new_rowid",
+			Columns: []Column{
+				{Name: "new_rowid", Source: "RowId", Type: TypeInteger},
+				{Name: "new_description", Source: "Description", Update: true},
+			},
+		},
+		Parent:       "new_faktura",
+		ParentColumn: "_new_faktura_value",
+	}
+}
+
+func TestCheckSchemaDefault(t *testing.T) {
+	metadata := parseSchema(t)
+	m := Default()
+	m.Rows = testRows()
+
+	if err := m.CheckSchema(metadata, distributorOptions); err != nil {
+		t.Errorf("CheckSchema: %v", err)
+	}
+	if err := m.CheckRowsSchema(metadata, nil); err != nil {
+		t.Errorf("CheckRowsSchema: %v", err)
+	}
+	if err := m.Accounts.CheckSchema(metadata, nil); err != nil {
+		t.Errorf("accounts CheckSchema: %v", err)
+	}
+}
+
+func TestCheckSchemaMismatches(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(m *Mapping)
+		want   []string
+	}{
+		{
+			"unknown entity set",
+			func(m *Mapping) { m.EntitySet = "new_faktura" },
+			[]string{`entity set "new_faktura" does not exist`},
+		},
+		{
+			"columns",
+			func(m *Mapping) {
+				m.IDColumn = "new_documentnumber"
+				m.Columns[1].Name = "new_Balance"
+				m.Columns[2].Type = TypeNumber
+				m.Columns[8].Value = 100000002
+			},
+			[]string{
+				`id_column "new_documentnumber" is not the primary key of new_faktura (new_fakturaid)`,
+				`column "new_Balance" does not exist in new_faktura`,
+				`column "new_booked" is Edm.Boolean in Dynamics 365, which cannot hold a number`,
+				`column "new_distributor": 100000002 is not one of the choices 100000000 (Direct), 100000001 (Partner)`,
+			},
+		},
+		{
+			"pdf and lookup",
+			func(m *Mapping) {
+				m.PDF.Column = "new_pdf"
+				m.Customer.MatchColumn = "accountnumber"
+			},
+			[]string{
+				`pdf column "new_pdf" does not exist in new_faktura`,
+				`customer match_column "accountnumber" does not exist in account`,
+			},
+		},
+		{
+			"lookup case",
+			func(m *Mapping) { m.Customer.NavigationProperty = "new_Customer_Account" },
+			[]string{`customer navigation_property "new_Customer_Account" does not exist in new_faktura (names are case sensitive)`},
+		},
+		{
+			"lookup to many",
+			func(m *Mapping) { m.Customer.NavigationProperty = "new_faktura_rows" },
+			[]string{`customer navigation_property "new_faktura_rows" leads to many records and cannot be bound`},
+		},
+		{
+			"lookup to another table",
+			func(m *Mapping) {
+				m.Customer.EntitySet = "new_fakturarads"
+				m.Customer.IDColumn = "new_fakturaradid"
+				m.Customer.MatchColumn = "new_description"
+			},
+			[]string{`customer navigation_property "new_customer_account" leads to account, not to new_fakturarads`},
+		},
+	}
+
+	metadata := parseSchema(t)
+	for _, tt := range tests {
+		m := Default()
+		tt.change(m)
+
+		err := m.CheckSchema(metadata, distributorOptions)
+		if err == nil {
+			t.Errorf("%s: CheckSchema = nil, want %d problems", tt.name, len(tt.want))
+			continue
+		}
+		problems := strings.Split(err.Error(), "\n")
+		if len(problems) != len(tt.want) {
+			t.Errorf("%s: CheckSchema reported\n%v\nwant %d problems", tt.name, err, len(tt.want))
+			continue
+		}
+		for i, want := range tt.want {
+			if problems[i] != want {
+				t.Errorf("%s: problem %d = %q, want %q", tt.name, i, problems[i], want)
+			}
+		}
+	}
+}
+
+func TestCheckRowsSchemaMismatches(t *testing.T) {
+	metadata := parseSchema(t)
+
+	m := Default()
+	m.Rows = testRows()
+	m.Rows.Parent = "new_account"
+	m.Rows.ParentColumn = "_new_invoice_value"
+	m.Rows.Columns[0].Type = TypeBoolean
+
+	err := m.CheckRowsSchema(metadata, nil)
+	want := []string{
+		`column "new_rowid" is Edm.Int32 in Dynamics 365, which cannot hold a boolean`,
+		`parent "new_account" leads to account, not to new_fakturas`,
+		`parent_column "_new_invoice_value" does not exist in new_fakturarad`,
+	}
+	if err == nil || err.Error() != strings.Join(want, "\n") {
+		t.Errorf("CheckRowsSchema = %v, want\n%s", err, strings.Join(want, "\n"))
+	}
+}
+
+func TestCheckAlternateKey(t *testing.T) {
+	const keyed = `<Annotation Term="OData.Community.Keys.V1.AlternateKeys"><Collection><Record><PropertyValue Property="Key"><Collection><Record>
+<PropertyValue Property="Name" PropertyPath="new_documentnumber" /></Record></Collection></PropertyValue></Record></Collection></Annotation>
+        <NavigationProperty Name="new_customer_account"`
+
+	m := Default()
+	if err := m.CheckAlternateKey(parseSchema(t)); err == nil || !strings.Contains(err.Error(), `key_column "new_documentnumber" is not an alternate key of new_faktura`) {
+		t.Errorf("CheckAlternateKey without the key = %v", err)
+	}
+
+	metadata, err := dynamics.ParseMetadata([]byte(strings.Replace(schemaXML, `<NavigationProperty Name="new_customer_account"`, keyed, 1)))
+	if err != nil {
+		t.Fatalf("ParseMetadata: %v", err)
+	}
+	if err := m.CheckAlternateKey(metadata); err != nil {
+		t.Errorf("CheckAlternateKey with the key = %v", err)
+	}
+}
@@ -0,0 +1,178 @@
+// Package retry implements the retry policy shared by the Fortnox and Dynamics 365 clients.
+package retry
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Policy decides whether and when a failed HTTP request is sent again
+type Policy struct {
+	MaxAttempts    int           // Total number of attempts, 1 disables retries
+	InitialBackoff time.Duration // Delay before the second attempt, doubled for every further attempt
+	MaxBackoff     time.Duration // Upper bound for a computed delay
+	MaxElapsed     time.Duration // No retry is started once this much time has passed, 0 means no limit
+	Jitter         float64       // Fraction of a computed delay that is randomised, between 0 and 1
+}
+
+// DefaultPolicy returns the policy used by the API clients unless configured otherwise
+func DefaultPolicy() Policy {
+	return Policy{
+		MaxAttempts:    6,
+		InitialBackoff: 500 * time.Millisecond,
+		MaxBackoff:     30 * time.Second,
+		MaxElapsed:     2 * time.Minute,
+		Jitter:         0.5,
+	}
+}
+
+// Attempt performs one try of a request and reports its status code, response headers
+// and any transport error. A status code of 0 means no response was received.
+type Attempt func(ctx context.Context) (statusCode int, header http.Header, err error)
+
+// Do runs attempt until it no longer fails in a retryable way, the attempts or time are
+// used up, or ctx is done. It returns the transport error of the last attempt, or the
+// context error if ctx ended while waiting; the caller keeps the last response itself.
+//
+// Non-idempotent requests (POST) are only retried when the server cannot have acted on
+// them: on 429 Too Many Requests, or when the connection could not be established.
+func (p Policy) Do(ctx context.Context, idempotent bool, attempt Attempt) error {
+	start := time.Now()
+
+	for n := 1; ; n++ {
+		statusCode, header, err := attempt(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if n >= p.MaxAttempts || !Retryable(statusCode, err, idempotent) {
+			return err
+		}
+
+		delay := p.backoff(n)
+		if after, ok := RetryAfter(header); ok {
+			delay = after
+		} else if RateLimitExhausted(header) && p.MaxBackoff > delay {
+			delay = p.MaxBackoff
+		}
+		if p.MaxElapsed > 0 && time.Since(start)+delay > p.MaxElapsed {
+			return err
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// backoff returns the jittered exponential delay after attempt n
+func (p Policy) backoff(n int) time.Duration {
+	d := p.InitialBackoff << (n - 1)
+	if d <= 0 || (p.MaxBackoff > 0 && d > p.MaxBackoff) {
+		d = p.MaxBackoff
+	}
+	if p.Jitter > 0 {
+		d -= time.Duration(float64(d) * p.Jitter * rand.Float64())
+	}
+	return d
+}
+
+// Retryable reports whether a request that ended with the given status code or
+// transport error may be sent again
+func Retryable(statusCode int, err error, idempotent bool) bool {
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			return false
+		}
+		if idempotent {
+			return isTransient(err)
+		}
+		return isDialError(err)
+	}
+
+	switch statusCode {
+	case http.StatusTooManyRequests:
+		return true
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return idempotent
+	}
+	return false
+}
+
+// RetryAfter returns the delay requested by the server, from the standard Retry-After
+// header (seconds or an HTTP date) or the x-ms-retry-after-ms header used by Dynamics 365
+func RetryAfter(header http.Header) (time.Duration, bool) {
+	if header == nil {
+		return 0, false
+	}
+	if v := header.Get("x-ms-retry-after-ms"); v != "" {
+		if ms, err := strconv.Atoi(v); err == nil && ms >= 0 {
+			return time.Duration(ms) * time.Millisecond, true
+		}
+	}
+	if v := header.Get("Retry-After"); v != "" {
+		if seconds, err := strconv.Atoi(v); err == nil && seconds >= 0 {
+			return time.Duration(seconds) * time.Second, true
+		}
+		if t, err := http.ParseTime(v); err == nil {
+			if d := time.Until(t); d > 0 {
+				return d, true
+			}
+			return 0, true
+		}
+	}
+	return 0, false
+}
+
+// RateLimitExhausted reports whether the Dynamics 365 service protection headers show
+// that no requests or execution time remain in the current window
+func RateLimitExhausted(header http.Header) bool {
+	for _, name := range []string{"x-ms-ratelimit-burst-remaining-xrm-requests", "x-ms-ratelimit-time-remaining-xrm-requests"} {
+		v := strings.ReplaceAll(header.Get(name), ",", "")
+		if v == "" {
+			continue
+		}
+		if remaining, err := strconv.ParseFloat(v, 64); err == nil && remaining <= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// isTransient reports whether err is a network error that is likely to go away on its own
+func isTransient(err error) bool {
+	if isTimeout(err) || isDialError(err) {
+		return true
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNABORTED) || errors.Is(err, syscall.EPIPE)
+}
+
+// isTimeout reports whether err is a timeout of a single attempt, for example from a per-request deadline
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// isDialError reports whether the connection could not be established, so the request was never sent
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) || errors.Is(err, syscall.ECONNREFUSED)
+}
@@ -0,0 +1,143 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRetryable(t *testing.T) {
+	dialErr := &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	readErr := &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+
+	tests := []struct {
+		name       string
+		statusCode int
+		err        error
+		idempotent bool
+		want       bool
+	}{
+		{"ok", http.StatusOK, nil, true, false},
+		{"bad request", http.StatusBadRequest, nil, true, false},
+		{"internal server error", http.StatusInternalServerError, nil, true, false},
+		{"too many requests", http.StatusTooManyRequests, nil, true, true},
+		{"too many requests post", http.StatusTooManyRequests, nil, false, true},
+		{"bad gateway", http.StatusBadGateway, nil, true, true},
+		{"service unavailable", http.StatusServiceUnavailable, nil, true, true},
+		{"gateway timeout", http.StatusGatewayTimeout, nil, true, true},
+
+		// A POST may have been acted on, so it is not repeated after a gateway error
+		{"bad gateway post", http.StatusBadGateway, nil, false, false},
+		{"service unavailable post", http.StatusServiceUnavailable, nil, false, false},
+		{"gateway timeout post", http.StatusGatewayTimeout, nil, false, false},
+
+		{"dial error", 0, dialErr, true, true},
+		{"dial error post", 0, dialErr, false, true},
+		{"dns error post", 0, &net.DNSError{Err: "no such host", Name: "api.fortnox.se"}, false, true},
+		{"connection reset", 0, readErr, true, true},
+		{"connection reset post", 0, readErr, false, false},
+		{"unexpected eof", 0, fmt.Errorf("reading body: %w", io.ErrUnexpectedEOF), true, true},
+		{"unexpected eof post", 0, io.ErrUnexpectedEOF, false, false},
+		{"timeout", 0, context.DeadlineExceeded, true, true},
+		{"timeout post", 0, context.DeadlineExceeded, false, false},
+		{"canceled", 0, context.Canceled, true, false},
+		{"other error", 0, errors.New("malformed request"), true, false},
+	}
+
+	for _, tt := range tests {
+		if got := Retryable(tt.statusCode, tt.err, tt.idempotent); got != tt.want {
+			t.Errorf("%s: Retryable(%d, %v, %v) = %v, want %v", tt.name, tt.statusCode, tt.err, tt.idempotent, got, tt.want)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+		want   time.Duration
+		ok     bool
+	}{
+		{"no header", nil, 0, false},
+		{"empty", http.Header{}, 0, false},
+		{"seconds", http.Header{"Retry-After": {"7"}}, 7 * time.Second, true},
+		{"zero seconds", http.Header{"Retry-After": {"0"}}, 0, true},
+		{"negative seconds", http.Header{"Retry-After": {"-1"}}, 0, false},
+		{"garbage", http.Header{"Retry-After": {"soon"}}, 0, false},
+		{"past date", http.Header{"Retry-After": {"Wed, 21 Oct 2015 07:28:00 GMT"}}, 0, true},
+		{"milliseconds", http.Header{"X-Ms-Retry-After-Ms": {"1500"}}, 1500 * time.Millisecond, true},
+		{"milliseconds before seconds", http.Header{"X-Ms-Retry-After-Ms": {"250"}, "Retry-After": {"10"}}, 250 * time.Millisecond, true},
+		{"invalid milliseconds", http.Header{"X-Ms-Retry-After-Ms": {"x"}, "Retry-After": {"3"}}, 3 * time.Second, true},
+	}
+
+	for _, tt := range tests {
+		got, ok := RetryAfter(tt.header)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("%s: RetryAfter = %v, %v, want %v, %v", tt.name, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestRetryAfterFutureDate(t *testing.T) {
+	header := http.Header{"Retry-After": {time.Now().Add(30 * time.Second).UTC().Format(http.TimeFormat)}}
+
+	// HTTP dates have whole seconds, so the delay is up to a second shorter
+	got, ok := RetryAfter(header)
+	if !ok || got <= 28*time.Second || got > 30*time.Second {
+		t.Errorf("RetryAfter = %v, %v, want about 30s", got, ok)
+	}
+}
+
+func TestRateLimitExhausted(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+		want   bool
+	}{
+		{"no header", nil, false},
+		{"requests left", http.Header{"X-Ms-Ratelimit-Burst-Remaining-Xrm-Requests": {"5999"}}, false},
+		{"no requests left", http.Header{"X-Ms-Ratelimit-Burst-Remaining-Xrm-Requests": {"0"}}, true},
+		{"time left", http.Header{"X-Ms-Ratelimit-Time-Remaining-Xrm-Requests": {"1,199,998.00"}}, false},
+		{"no time left", http.Header{"X-Ms-Ratelimit-Time-Remaining-Xrm-Requests": {"0.00"}}, true},
+		{"time overdrawn", http.Header{"X-Ms-Ratelimit-Time-Remaining-Xrm-Requests": {"-1,200.50"}}, true},
+		{"garbage", http.Header{"X-Ms-Ratelimit-Burst-Remaining-Xrm-Requests": {"n/a"}}, false},
+	}
+
+	for _, tt := range tests {
+		if got := RateLimitExhausted(tt.header); got != tt.want {
+			t.Errorf("%s: RateLimitExhausted = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDoPostIsNotRepeatedAfterGatewayError(t *testing.T) {
+	p := Policy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+
+	tests := []struct {
+		name       string
+		statusCode int
+		idempotent bool
+		want       int
+	}{
+		{"get after 503", http.StatusServiceUnavailable, true, 3},
+		{"post after 503", http.StatusServiceUnavailable, false, 1},
+		{"post after 429", http.StatusTooManyRequests, false, 3},
+	}
+
+	for _, tt := range tests {
+		attempts := 0
+		err := p.Do(context.Background(), tt.idempotent, func(ctx context.Context) (int, http.Header, error) {
+			attempts++
+			return tt.statusCode, http.Header{"Retry-After": {"0"}}, nil
+		})
+		if err != nil || attempts != tt.want {
+			t.Errorf("%s: %d attempts, %v, want %d attempts", tt.name, attempts, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+// Package state provides a file-backed store that remembers which Fortnox invoices
+// have already been synchronised to Dynamics 365.
+package state
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Record describes the last successful synchronisation of a single Fortnox invoice.
+// An incomplete record points at a Dynamics 365 invoice that was created but could not be
+// finished or rolled back, and must be repaired by the next sync.
+type Record struct {
+	InvoiceID  string    `json:"invoice_id"`
+	Hash       string    `json:"hash"`
+	SyncedAt   time.Time `json:"synced_at"`
+	Incomplete bool      `json:"incomplete,omitempty"`
+}
+
+// Failure describes an invoice that could not be synchronised, kept until a later sync succeeds
+type Failure struct {
+	Stage         string          `json:"stage"`
+	Error         string          `json:"error"`
+	Attempts      int             `json:"attempts"`
+	FirstFailedAt time.Time       `json:"first_failed_at"`
+	LastFailedAt  time.Time       `json:"last_failed_at"`
+	Invoice       json.RawMessage `json:"invoice,omitempty"` // The source invoice, so that it can be retried without refetching
+}
+
+// storeData is the on-disk representation of the store
+type storeData struct {
+	Watermark time.Time          `json:"watermark"`
+	Invoices  map[string]Record  `json:"invoices"`
+	Failures  map[string]Failure `json:"failures,omitempty"`
+}
+
+// Store keeps sync records keyed by Fortnox DocumentNumber.
+// It is safe for concurrent use by multiple goroutines.
+type Store struct {
+	path   string
+	mu     sync.Mutex
+	saveMu sync.Mutex // Serialises Save, so that an older snapshot never replaces a newer one
+	data   storeData
+}
+
+// Open loads the store from the given path.
+// A missing file is not an error; an empty store is returned and the file is created on Save.
+func Open(path string) (*Store, error) {
+	s := &Store{
+		path: path,
+		data: storeData{Invoices: make(map[string]Record), Failures: make(map[string]Failure)},
+	}
+
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading state file %s: %v", path, err)
+	}
+
+	if err := json.Unmarshal(raw, &s.data); err != nil {
+		return nil, fmt.Errorf("error parsing state file %s: %v", path, err)
+	}
+	if s.data.Invoices == nil {
+		s.data.Invoices = make(map[string]Record)
+	}
+	if s.data.Failures == nil {
+		s.data.Failures = make(map[string]Failure)
+	}
+
+	return s, nil
+}
+
+// Get returns the record for a Fortnox document number and whether it exists
+func (s *Store) Get(documentNumber string) (Record, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rec, ok := s.data.Invoices[documentNumber]
+	return rec, ok
+}
+
+// Put stores the record for a Fortnox document number
+func (s *Store) Put(documentNumber string, rec Record) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.data.Invoices[documentNumber] = rec
+}
+
+// Delete removes the record for a Fortnox document number, for example when its
+// Dynamics 365 invoice no longer exists
+func (s *Store) Delete(documentNumber string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.data.Invoices, documentNumber)
+}
+
+// RecordFailure records a failed attempt to sync an invoice at the given stage,
+// counting the attempts made since the invoice last synced successfully
+func (s *Store) RecordFailure(documentNumber, stage string, err error, invoice json.RawMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	f, ok := s.data.Failures[documentNumber]
+	if !ok {
+		f.FirstFailedAt = now
+	}
+	f.Stage = stage
+	f.Error = err.Error()
+	f.Attempts++
+	f.LastFailedAt = now
+	if invoice != nil {
+		f.Invoice = invoice
+	}
+	s.data.Failures[documentNumber] = f
+}
+
+// ClearFailure removes the failure record of an invoice, typically after it synced successfully
+func (s *Store) ClearFailure(documentNumber string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.data.Failures, documentNumber)
+}
+
+// Failures returns a copy of all failure records keyed by Fortnox document number
+func (s *Store) Failures() map[string]Failure {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	failures := make(map[string]Failure, len(s.data.Failures))
+	for documentNumber, f := range s.data.Failures {
+		failures[documentNumber] = f
+	}
+	return failures
+}
+
+// Watermark returns the start time of the last successful incremental run.
+// The zero time is returned if no run has completed yet.
+func (s *Store) Watermark() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.data.Watermark
+}
+
+// SetWatermark records the start time of a successful run
+func (s *Store) SetWatermark(t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.data.Watermark = t
+}
+
+// Save writes the store to disk. The file is replaced atomically so that an
+// interrupted run never leaves a truncated state file behind. Save may be called
+// while the store is in use, to keep progress made during a run.
+func (s *Store) Save() error {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+
+	s.mu.Lock()
+	data, err := json.MarshalIndent(s.data, "", "  ")
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("error creating temporary state file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing state file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error writing state file: %v", err)
+	}
+
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// Hash returns a stable content hash of v, based on its JSON representation.
+// It is used to detect whether a mapped invoice has changed since it was last synced.
+func Hash(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,210 @@
+package state
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestOpenMissingFile(t *testing.T) {
+	s, err := Open(filepath.Join(t.TempDir(), "sync_state.json"))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if !s.Watermark().IsZero() || len(s.Failures()) != 0 {
+		t.Errorf("new store has watermark %v and %d failures, want none", s.Watermark(), len(s.Failures()))
+	}
+	if _, ok := s.Get("1"); ok {
+		t.Error("Get on an empty store found a record")
+	}
+}
+
+func TestOpenInvalidFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sync_state.json")
+	if err := os.WriteFile(path, []byte(`{"invoices":`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path); err == nil {
+		t.Error("Open = nil, want an error for a truncated state file")
+	}
+}
+
+func TestSaveAndReopen(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "sync_state.json")
+
+	s, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	watermark := time.Date(2024, 5, 2, 13, 45, 0, 0, time.UTC)
+	rec := Record{InvoiceID: "6c2b3f4e-1a2b-ef11-8ee8-000d3ab8c4f1", Hash: "abc", SyncedAt: watermark, Incomplete: true}
+	s.Put("1001", rec)
+	s.SetWatermark(watermark)
+	s.RecordFailure("1002", "create", errors.New("400 Bad Request"), json.RawMessage(`{"DocumentNumber":"1002"}`))
+	if err := s.Save(); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	// The temporary file is renamed over the state file, nothing else is left behind
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "sync_state.json" {
+		t.Errorf("directory holds %v, want only sync_state.json", entries)
+	}
+
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if got, ok := reopened.Get("1001"); !ok || got != rec {
+		t.Errorf("Get = %+v, %v, want %+v", got, ok, rec)
+	}
+	if got := reopened.Watermark(); !got.Equal(watermark) {
+		t.Errorf("Watermark = %v, want %v", got, watermark)
+	}
+	f, ok := reopened.Failures()["1002"]
+	if !ok || f.Stage != "create" || f.Error != "400 Bad Request" || f.Attempts != 1 {
+		t.Errorf("failure = %+v, %v", f, ok)
+	}
+	// The saved invoice is indented along with the rest of the file
+	var invoice bytes.Buffer
+	if err := json.Compact(&invoice, f.Invoice); err != nil || invoice.String() != `{"DocumentNumber":"1002"}` {
+		t.Errorf("failure invoice = %s, %v", f.Invoice, err)
+	}
+}
+
+func TestSaveReplacesExistingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sync_state.json")
+	if err := os.WriteFile(path, []byte(`{"invoices":{"1":{"invoice_id":"old"}}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	s.Put("1", Record{InvoiceID: "new"})
+	if err := s.Save(); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if got, _ := reopened.Get("1"); got.InvoiceID != "new" {
+		t.Errorf("InvoiceID = %q, want new", got.InvoiceID)
+	}
+}
+
+func TestSaveFailureKeepsExistingFile(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "state")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "sync_state.json")
+	original := []byte(`{"watermark":"2024-05-02T13:45:00Z","invoices":{}}`)
+	if err := os.WriteFile(path, original, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	s.SetWatermark(time.Now())
+
+	// Without write permission on the directory no temporary file can be created
+	if err := os.Chmod(dir, 0o555); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(dir, 0o755)
+	if f, err := os.CreateTemp(dir, "probe"); err == nil {
+		f.Close()
+		os.Remove(f.Name())
+		t.Skip("directory permissions are not enforced, for example when running as root")
+	}
+
+	if err := s.Save(); err == nil {
+		t.Fatal("Save = nil, want an error")
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != string(original) {
+		t.Errorf("state file = %q, %v, want it unchanged", data, err)
+	}
+}
+
+func TestRecordFailure(t *testing.T) {
+	s, err := Open(filepath.Join(t.TempDir(), "sync_state.json"))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	invoice := json.RawMessage(`{"DocumentNumber":"1"}`)
+
+	s.RecordFailure("1", "fetch", errors.New("timeout"), invoice)
+	first := s.Failures()["1"]
+	s.RecordFailure("1", "create", errors.New("400 Bad Request"), nil)
+	second := s.Failures()["1"]
+
+	if second.Attempts != 2 || second.Stage != "create" || second.Error != "400 Bad Request" {
+		t.Errorf("failure = %+v, want 2 attempts at create", second)
+	}
+	if !second.FirstFailedAt.Equal(first.FirstFailedAt) || second.LastFailedAt.Before(first.LastFailedAt) {
+		t.Errorf("failure times = %v, %v, want the first kept and the last moved", second.FirstFailedAt, second.LastFailedAt)
+	}
+	// A failure without the invoice keeps the one recorded earlier
+	if string(second.Invoice) != string(invoice) {
+		t.Errorf("Invoice = %s, want %s", second.Invoice, invoice)
+	}
+
+	s.ClearFailure("1")
+	if _, ok := s.Failures()["1"]; ok {
+		t.Error("failure still recorded after ClearFailure")
+	}
+
+	s.RecordFailure("1", "create", errors.New("again"), nil)
+	if f := s.Failures()["1"]; f.Attempts != 1 {
+		t.Errorf("Attempts = %d after a cleared failure, want 1", f.Attempts)
+	}
+}
+
+func TestFailuresReturnsCopy(t *testing.T) {
+	s, err := Open(filepath.Join(t.TempDir(), "sync_state.json"))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	s.RecordFailure("1", "create", errors.New("failed"), nil)
+
+	failures := s.Failures()
+	delete(failures, "1")
+	if _, ok := s.Failures()["1"]; !ok {
+		t.Error("changing the returned map changed the store")
+	}
+}
+
+func TestHash(t *testing.T) {
+	type invoice struct {
+		DocumentNumber string
+		Total          float64
+	}
+
+	a, err := Hash(invoice{"1", 100})
+	if err != nil {
+		t.Fatalf("Hash: %v", err)
+	}
+	b, _ := Hash(invoice{"1", 100})
+	c, _ := Hash(invoice{"1", 100.5})
+
+	if a != b {
+		t.Errorf("Hash differs for equal values: %s, %s", a, b)
+	}
+	if a == c {
+		t.Error("Hash is the same for different values")
+	}
+}
@@ -0,0 +1,644 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"fortnox_dynamics_integration/pkg/dynamics"
+	"fortnox_dynamics_integration/pkg/fortnox"
+	"fortnox_dynamics_integration/pkg/mapping"
+	"fortnox_dynamics_integration/pkg/state"
+)
+
+// invoiceWriter är de skrivande anropen mot Dynamics 365 som synkroniseringen gör.
+// *dynamics.D365 uppfyller gränssnittet, och vid --dry-run används planRecorder istället.
+type invoiceWriter interface {
+	CreateRecordContext(ctx context.Context, entitySet string, record interface{}) (string, error)
+	UpdateRecordContext(ctx context.Context, entitySet, id string, changes map[string]interface{}) error
+	UploadFileToContext(ctx context.Context, entitySet, entityID, field, filename string, fileData []byte) error
+	UpsertContext(ctx context.Context, entitySet string, alternateKey map[string]interface{}, body interface{}, condition dynamics.UpsertCondition) (dynamics.UpsertResult, error)
+	DeleteRecordContext(ctx context.Context, entitySet, id string) error
+	ExecuteBatchContext(ctx context.Context, batch *dynamics.Batch) error
+}
+
+// syncer håller ihop klienterna och lagret som behövs för att synkronisera fakturor
+type syncer struct {
+	fortnox  *fortnox.FortnoxClient
+	dynamics *dynamics.D365
+	writer   invoiceWriter
+	store    *state.Store
+	mapping  *mapping.Mapping // Hur fakturorna översätts till tabellen i Dynamics 365
+
+	batchSize       int  // Antal fakturor per $batch-anrop, 1 skriver varje faktura för sig
+	upsert          bool // Nya fakturor skrivs med upsert på mappningens nyckelkolumn istället för sökning och skapande
+	createCustomers bool // Kunder som saknas i Dynamics 365 hämtas från Fortnox och skapas som konton
+	saveProgress    bool // Lagret sparas under körningen när en faktura skapas eller blir ofullständig
+
+	customerMu  sync.Mutex
+	customerIDs map[string]string // Konton som skapats för fakturor under körningen, per kundnummer
+}
+
+// Steg i synkroniseringen av en faktura, sparas med misslyckade fakturor
+const (
+	stageFetchInvoice = "fetch-invoice"
+	stageMap          = "map"
+	stageHash         = "hash"
+	stageSearch       = "search"
+	stageCustomer     = "customer"
+	stageFetch        = "fetch"
+	stageFetchPDF     = "fetch-pdf"
+	stageCreate       = "create"
+	stageUpdate       = "update"
+	stageRows         = "rows"
+	stageUpload       = "upload"
+)
+
+// stageError anger i vilket steg synkroniseringen av en faktura misslyckades
+type stageError struct {
+	stage string
+	err   error
+}
+
+func (e *stageError) Error() string { return e.err.Error() }
+
+func (e *stageError) Unwrap() error { return e.err }
+
+// atStage märker err med steget det uppstod i
+func atStage(stage string, err error) error {
+	return &stageError{stage: stage, err: err}
+}
+
+// failedStage returnerar steget i synkroniseringen som ett fel uppstod i, eller "unknown"
+func failedStage(err error) string {
+	var stageErr *stageError
+	if errors.As(err, &stageErr) {
+		return stageErr.stage
+	}
+	return "unknown"
+}
+
+// runResult sammanfattar en synkroniseringskörning
+type runResult struct {
+	failed    atomic.Int64
+	temporary atomic.Int64 // De misslyckade fakturor vars senaste fel var tillfälligt
+	skipped   atomic.Int64
+
+	mu    sync.Mutex
+	retry []fortnox.Invoice // Fakturor med tillfälliga fel som försöks igen efter första varvet
+}
+
+// run synkroniserar fakturorna med numWorkers parallella workers. Fakturor som misslyckas
+// med tillfälliga fel försöks en gång till när alla övriga har behandlats.
+//
+// Varje varv har två steg. Först tar numWorkers workers fram vad som ska skrivas för varje
+// faktura med prepareInvoice. Planerna samlas sedan i grupper om batchSize fakturor som
+// skrivs till Dynamics 365 i ett $batch-anrop per grupp av lika många workers.
+func (s *syncer) run(stopping, ctx context.Context, invoices []fortnox.Invoice) *runResult {
+	result := &runResult{}
+
+	s.runPass(stopping, ctx, invoices, result, true)
+
+	if len(result.retry) > 0 && stopping.Err() == nil {
+		retry := result.retry
+		result.retry = nil
+		log.Printf("Retrying %d invoices that failed with temporary errors", len(retry))
+		s.runPass(stopping, ctx, retry, result, false)
+	}
+
+	return result
+}
+
+// runPass kör ett varv av synkroniseringen över fakturorna
+func (s *syncer) runPass(stopping, ctx context.Context, invoices []fortnox.Invoice, result *runResult, retryLater bool) {
+	invoiceChan := make(chan fortnox.Invoice, len(invoices))
+	planChan := make(chan *invoicePlan, s.batchSize)
+	batchChan := make(chan []*invoicePlan)
+	var prepared, applied sync.WaitGroup
+
+	for i := 0; i < numWorkers; i++ {
+		prepared.Add(1)
+		go s.prepareWorker(stopping, ctx, invoiceChan, planChan, result, retryLater, &prepared)
+		applied.Add(1)
+		go s.applyWorker(ctx, batchChan, result, retryLater, &applied)
+	}
+
+	for _, invoice := range invoices {
+		invoiceChan <- invoice
+	}
+	close(invoiceChan)
+
+	go func() {
+		prepared.Wait()
+		close(planChan)
+	}()
+
+	// Samla planerna i grupper om batchSize fakturor
+	batch := make([]*invoicePlan, 0, s.batchSize)
+	for plan := range planChan {
+		batch = append(batch, plan)
+		if len(batch) == s.batchSize {
+			batchChan <- batch
+			batch = make([]*invoicePlan, 0, s.batchSize)
+		}
+	}
+	if len(batch) > 0 {
+		batchChan <- batch
+	}
+	close(batchChan)
+
+	applied.Wait()
+}
+
+// prepareWorker tar fram planer för fakturor från kanalen tills den är tom eller stopping avbryts.
+// En faktura som redan har påbörjats körs klart med ctx, som bara avbryts vid ett hårt stopp.
+func (s *syncer) prepareWorker(stopping, ctx context.Context, invoices <-chan fortnox.Invoice, plans chan<- *invoicePlan, result *runResult, retryLater bool, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	for invoice := range invoices {
+		if stopping.Err() != nil {
+			return
+		}
+
+		plan, err := s.prepareInvoice(ctx, invoice)
+		switch {
+		case err != nil:
+			s.handleFailure(invoice, err, result, retryLater)
+		case plan == nil:
+			s.store.ClearFailure(invoice.DocumentNumber)
+		case !plan.needsWrite():
+			s.finishInvoice(plan)
+		default:
+			plans <- plan
+		}
+	}
+}
+
+// applyWorker skriver grupper av fakturor till Dynamics 365 tills kanalen stängs
+func (s *syncer) applyWorker(ctx context.Context, batches <-chan []*invoicePlan, result *runResult, retryLater bool, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	for batch := range batches {
+		s.applyPlans(ctx, batch, result, retryLater)
+	}
+}
+
+// handleFailure avgör vad som händer med en faktura som misslyckades. Alla misslyckade
+// försök sparas i lagret, så att fakturan kan försökas igen med "retry-failed" om även
+// ett senare försök misslyckas.
+func (s *syncer) handleFailure(invoice fortnox.Invoice, err error, result *runResult, retryLater bool) {
+	action := classifyError(err)
+
+	if action == actionSkip {
+		log.Printf("Skipping invoice %s: %v", invoice.DocumentNumber, err)
+		s.store.ClearFailure(invoice.DocumentNumber)
+		result.skipped.Add(1)
+		return
+	}
+
+	s.recordFailure(invoice, err)
+
+	if action == actionRetry && retryLater {
+		log.Printf("Invoice %s failed with a temporary error, will retry: %v", invoice.DocumentNumber, err)
+		result.mu.Lock()
+		result.retry = append(result.retry, invoice)
+		result.mu.Unlock()
+		return
+	}
+
+	log.Printf("Failed to process invoice %s at stage %s (%s): %v", invoice.DocumentNumber, failedStage(err), action, err)
+	result.failed.Add(1)
+	if action == actionRetry {
+		result.temporary.Add(1)
+	}
+}
+
+// recordFailure sparar det misslyckade försöket tillsammans med fakturan från Fortnox
+func (s *syncer) recordFailure(invoice fortnox.Invoice, err error) {
+	data, marshalErr := json.Marshal(invoice)
+	if marshalErr != nil {
+		log.Printf("Failed to encode invoice %s for the failure record: %v", invoice.DocumentNumber, marshalErr)
+	}
+	s.store.RecordFailure(invoice.DocumentNumber, failedStage(err), err, data)
+}
+
+// invoicePlan är det som behöver skrivas till Dynamics 365 för en faktura
+type invoicePlan struct {
+	invoice   fortnox.Invoice
+	record    dynamics.Record   // Fakturan översatt enligt mappningen
+	rows      []dynamics.Record // Fakturans rader översatta enligt mappningen, om rader synkroniseras
+	hash      string
+	create    bool                   // Fakturan finns inte i Dynamics 365 och ska skapas
+	upsert    bool                   // Fakturan skapas eller uppdateras via nyckelkolumnen
+	created   bool                   // Fakturan skapades i Dynamics 365 av den här körningen
+	invoiceID string                 // Fakturan i Dynamics 365, sätts när en ny faktura har skrivits
+	changes   map[string]interface{} // Ändrade kolumner i en befintlig faktura
+	uploadPDF bool                   // PDF-filen ska laddas upp
+	repair    bool                   // Fakturan skapades tidigare men blev aldrig klar
+	syncRows  bool                   // Raderna i Dynamics 365 ska göras lika med raderna i Fortnox
+	rowWrites int                    // Antal rader som skapats, uppdaterats eller tagits bort
+	pdf       []byte
+	started   time.Time
+}
+
+func (p *invoicePlan) needsWrite() bool {
+	return p.create || p.upsert || len(p.changes) > 0 || p.uploadPDF || p.syncRows
+}
+
+// prepareInvoice tar reda på vad som behöver skrivas för fakturan, utan att skriva något.
+// Den returnerar nil om fakturan inte har ändrats sedan förra synkroniseringen.
+//
+// När mappningen har rader hämtas varje faktura i sin helhet från Fortnox, eftersom
+// fakturalistan saknar rader, och raderna ingår i hashen så att ändrade rader upptäcks.
+func (s *syncer) prepareInvoice(ctx context.Context, invoice fortnox.Invoice) (*invoicePlan, error) {
+	rows := s.mapping.Rows
+	if rows != nil {
+		full, err := s.fortnox.FetchInvoiceContext(ctx, invoice.DocumentNumber)
+		if err != nil {
+			return nil, atStage(stageFetchInvoice, fmt.Errorf("failed to fetch invoice rows for document number %s: %w", invoice.DocumentNumber, err))
+		}
+		invoice = *full
+	}
+
+	// Förbered data för Dynamics 365
+	record, err := s.mapping.Apply(invoice)
+	if err != nil {
+		return nil, atStage(stageMap, fmt.Errorf("failed to map invoice for document number %s: %w", invoice.DocumentNumber, err))
+	}
+	plan := &invoicePlan{invoice: invoice, record: record, started: time.Now()}
+
+	var hashed interface{} = plan.record
+	if rows != nil {
+		for _, row := range invoice.InvoiceRows {
+			rowRecord, err := rows.Apply(row)
+			if err != nil {
+				return nil, atStage(stageMap, fmt.Errorf("failed to map row %d of invoice for document number %s: %w", row.RowId, invoice.DocumentNumber, err))
+			}
+			plan.rows = append(plan.rows, rowRecord)
+		}
+		hashed = []interface{}{plan.record, plan.rows}
+	}
+	hash, err := state.Hash(hashed)
+	if err != nil {
+		return nil, atStage(stageHash, fmt.Errorf("failed to hash invoice for document number %s: %w", invoice.DocumentNumber, err))
+	}
+	plan.hash = hash
+
+	// Hoppa över fakturor som inte har ändrats sedan förra synkroniseringen
+	synced, known := s.store.Get(invoice.DocumentNumber)
+	if known && synced.Hash == hash && !synced.Incomplete {
+		log.Printf("Invoice %s is unchanged since %s, skipping", invoice.DocumentNumber, synced.SyncedAt.Format(time.RFC3339))
+		return nil, nil
+	}
+
+	// Kontrollera om fakturan redan finns i Dynamics 365. Med en alternativ nyckel på
+	// nyckelkolumnen behövs ingen sökning, fakturan skapas eller uppdateras i samma anrop.
+	m := s.mapping
+	plan.invoiceID = synced.InvoiceID
+	switch {
+	case known:
+	case s.upsert:
+		plan.upsert = true
+	default:
+		plan.invoiceID, err = s.dynamics.FindRecordIDContext(ctx, m.EntitySet, m.IDColumn, dynamics.Eq(m.KeyColumn, m.Key(record)))
+		if err != nil {
+			return nil, atStage(stageSearch, fmt.Errorf("failed to search invoice for document number %s: %w", invoice.DocumentNumber, err))
+		}
+	}
+	plan.create = plan.invoiceID == "" && !plan.upsert
+	plan.repair = synced.Incomplete
+	plan.syncRows = rows != nil
+
+	// Nya fakturor, och fakturor som aldrig blev klara, får kunden satt i samma anrop
+	var customerID string
+	if (plan.create || plan.upsert || plan.repair) && m.Customer.NavigationProperty != "" {
+		customerID, err = s.findCustomer(ctx, invoice)
+		if err != nil {
+			return nil, err
+		}
+		plan.record.Bind(m.Customer.NavigationProperty, m.Customer.EntitySet, customerID)
+	}
+
+	if plan.create || plan.upsert {
+		plan.uploadPDF = m.PDF.Column != ""
+		return plan, nil
+	}
+
+	existing, err := s.dynamics.GetRecordContext(ctx, m.EntitySet, plan.invoiceID, m.UpdateColumns()...)
+	var odataErr *dynamics.ODataError
+	if known && errors.As(err, &odataErr) && odataErr.NotFound() {
+		// Fakturan har tagits bort i Dynamics 365. Glöm det sparade ID:t och planera om
+		// fakturan, så att den söks upp eller skapas igen istället för att fastna som felaktig.
+		log.Printf("Invoice ID %s for document number %s no longer exists in Dynamics 365, syncing it again", plan.invoiceID, invoice.DocumentNumber)
+		s.store.Delete(invoice.DocumentNumber)
+		return s.prepareInvoice(ctx, invoice)
+	}
+	if err != nil {
+		return nil, atStage(stageFetch, fmt.Errorf("failed to fetch invoice ID %s, document number %s from Dynamics 365: %w", plan.invoiceID, invoice.DocumentNumber, err))
+	}
+	plan.changes = m.Diff(existing, plan.record)
+	if customerID != "" {
+		plan.changes[dynamics.BindAnnotation(m.Customer.NavigationProperty)] = dynamics.EntityReference(m.Customer.EntitySet, customerID)
+	}
+
+	// Bara kolumner markerade med refresh_pdf ändrar själva fakturadokumentet
+	plan.uploadPDF = m.PDF.Column != "" && (m.RefreshesPDF(plan.changes) || plan.repair)
+
+	return plan, nil
+}
+
+// findCustomer söker upp kunden för fakturan i Dynamics 365 enligt mappningens kunduppslag
+func (s *syncer) findCustomer(ctx context.Context, invoice fortnox.Invoice) (string, error) {
+	lookup := s.mapping.Customer
+	customerID, err := s.dynamics.FindRecordIDContext(ctx, lookup.EntitySet, lookup.IDColumn, dynamics.Eq(lookup.MatchColumn, s.mapping.CustomerValue(invoice)))
+	if err != nil {
+		return "", atStage(stageCustomer, fmt.Errorf("failed to search customer for customer number %s, document number %s: %w", invoice.CustomerNumber, invoice.DocumentNumber, err))
+	}
+
+	if customerID == "" && s.createCustomers {
+		customerID, err = s.createMissingCustomer(ctx, invoice)
+		if err != nil {
+			return "", atStage(stageCustomer, err)
+		}
+	}
+
+	if customerID == "" {
+		return "", atStage(stageCustomer, fmt.Errorf("no customer found for customer number %s, document number %s", invoice.CustomerNumber, invoice.DocumentNumber))
+	}
+
+	return customerID, nil
+}
+
+// applyPlans skriver en grupp fakturor till Dynamics 365 och laddar upp deras PDF-filer
+func (s *syncer) applyPlans(ctx context.Context, plans []*invoicePlan, result *runResult, retryLater bool) {
+	// Hämta PDF-filerna innan något skrivs, så att en saknad PDF inte lämnar en halvfärdig faktura
+	ready := make([]*invoicePlan, 0, len(plans))
+	for _, plan := range plans {
+		if plan.uploadPDF {
+			invoicePDF, err := s.fortnox.FetchInvoicePDFContext(ctx, plan.invoice.DocumentNumber)
+			if err != nil {
+				s.handleFailure(plan.invoice, atStage(stageFetchPDF, fmt.Errorf("failed to fetch invoice PDF for document number %s: %w", plan.invoice.DocumentNumber, err)), result, retryLater)
+				continue
+			}
+			plan.pdf = invoicePDF
+		}
+		ready = append(ready, plan)
+	}
+
+	errs := s.writeInvoices(ctx, ready)
+
+	for i, plan := range ready {
+		if errs[i] != nil {
+			s.handleFailure(plan.invoice, errs[i], result, retryLater)
+			continue
+		}
+
+		if plan.syncRows {
+			if err := s.writeRows(ctx, plan); err != nil {
+				if plan.created {
+					s.rollbackInvoice(ctx, plan.invoiceID, plan.invoice.DocumentNumber)
+				}
+				s.handleFailure(plan.invoice, err, result, retryLater)
+				continue
+			}
+		}
+
+		if plan.uploadPDF {
+			err := s.writer.UploadFileToContext(ctx, s.mapping.EntitySet, plan.invoiceID, s.mapping.PDF.Column, s.mapping.PDFFilename(plan.invoice), plan.pdf)
+			if err != nil {
+				// Skapa och ladda upp hör ihop. Blir fakturan inte klar tas den bort igen, annars
+				// skulle nästa körning hitta den med SearchInvoice och tro att den är klar.
+				if plan.created {
+					s.rollbackInvoice(ctx, plan.invoiceID, plan.invoice.DocumentNumber)
+				}
+				s.handleFailure(plan.invoice, atStage(stageUpload, fmt.Errorf("failed to upload invoice PDF for invoice ID %s, document number %s to Dynamics 365: %w", plan.invoiceID, plan.invoice.DocumentNumber, err)), result, retryLater)
+				continue
+			}
+		}
+
+		s.finishInvoice(plan)
+	}
+}
+
+// writeInvoices skapar och uppdaterar fakturorna, med ett $batch-anrop om det är fler än en
+// och batchar är påslagna. Nya fakturor får sitt ID i plan.invoiceID. Felet för varje faktura
+// returneras på samma plats som fakturan.
+func (s *syncer) writeInvoices(ctx context.Context, plans []*invoicePlan) []error {
+	errs := make([]error, len(plans))
+
+	if s.batchSize <= 1 || len(plans) <= 1 {
+		for i, plan := range plans {
+			errs[i] = s.writeInvoice(ctx, plan)
+		}
+		return errs
+	}
+
+	// Fakturorna är oberoende av varandra, så ett fel ska inte stoppa resten av batchen
+	m := s.mapping
+	batch := dynamics.NewBatch()
+	batch.ContinueOnError = true
+	ops := make([]*dynamics.BatchOperation, len(plans))
+	for i, plan := range plans {
+		switch {
+		case plan.create:
+			ops[i] = batch.Post(m.EntitySet, plan.record)
+		case plan.upsert:
+			ops[i] = batch.Upsert(m.EntitySet, s.invoiceKey(plan), plan.record, dynamics.UpsertAny)
+		case len(plan.changes) > 0:
+			ops[i] = batch.Patch(fmt.Sprintf("%s(%s)", m.EntitySet, plan.invoiceID), plan.changes)
+		}
+	}
+
+	if err := s.writer.ExecuteBatchContext(ctx, batch); err != nil {
+		for i, plan := range plans {
+			if ops[i] != nil {
+				errs[i] = writeError(plan, err)
+			}
+		}
+		return errs
+	}
+
+	for i, plan := range plans {
+		switch {
+		case ops[i] == nil:
+		case ops[i].Err != nil:
+			errs[i] = writeError(plan, ops[i].Err)
+		case plan.create || plan.upsert:
+			plan.invoiceID = ops[i].RecordID(m.IDColumn)
+			plan.created = plan.create || ops[i].StatusCode == http.StatusCreated
+			if plan.invoiceID == "" {
+				errs[i] = writeError(plan, fmt.Errorf("no invoice ID in the batch response"))
+			}
+		}
+	}
+	return errs
+}
+
+// writeInvoice skapar eller uppdaterar en enskild faktura
+func (s *syncer) writeInvoice(ctx context.Context, plan *invoicePlan) error {
+	m := s.mapping
+	switch {
+	case plan.create:
+		invoiceID, err := s.writer.CreateRecordContext(ctx, m.EntitySet, plan.record)
+		if err != nil {
+			return writeError(plan, err)
+		}
+		plan.invoiceID, plan.created = invoiceID, true
+		return nil
+	case plan.upsert:
+		result, err := s.writer.UpsertContext(ctx, m.EntitySet, s.invoiceKey(plan), plan.record, dynamics.UpsertAny)
+		if err != nil {
+			return writeError(plan, err)
+		}
+		plan.invoiceID, plan.created = result.RecordID(m.IDColumn), result.Created
+		if plan.invoiceID == "" {
+			return writeError(plan, fmt.Errorf("no invoice ID in the upsert response"))
+		}
+		return nil
+	}
+
+	if len(plan.changes) > 0 {
+		if err := s.writer.UpdateRecordContext(ctx, m.EntitySet, plan.invoiceID, plan.changes); err != nil {
+			return writeError(plan, err)
+		}
+	}
+	return nil
+}
+
+// writeRows gör fakturans rader i Dynamics 365 lika med raderna i Fortnox. Raderna matchas
+// på nyckelkolumnen: saknade rader skapas kopplade till fakturan, ändrade uppdateras och
+// rader som inte längre finns i Fortnox tas bort.
+func (s *syncer) writeRows(ctx context.Context, plan *invoicePlan) error {
+	rows := s.mapping.Rows
+	documentNumber := plan.invoice.DocumentNumber
+
+	// En nyskapad faktura har inga rader, och vid --dry-run finns den påhittade fakturan inte i Dynamics 365
+	existing := make(map[string][]dynamics.Record)
+	if !plan.created && !strings.HasPrefix(plan.invoiceID, dryRunIDPrefix) {
+		query := dynamics.NewQuery(rows.EntitySet).
+			Filter(dynamics.Eq(rows.ParentColumn, dynamics.GUID(plan.invoiceID))).
+			Select(append([]string{rows.IDColumn, rows.KeyColumn}, rows.UpdateColumns()...)...)
+		records, err := dynamics.Collect[dynamics.Record](s.dynamics.QueryContext(ctx, query))
+		if err != nil {
+			return atStage(stageRows, fmt.Errorf("failed to fetch rows of invoice ID %s, document number %s from Dynamics 365: %w", plan.invoiceID, documentNumber, err))
+		}
+		for _, record := range records {
+			key := rows.KeyString(record)
+			existing[key] = append(existing[key], record)
+		}
+	}
+
+	for _, row := range plan.rows {
+		key := rows.KeyString(row)
+		matches := existing[key]
+		if len(matches) == 0 {
+			row.Bind(rows.Parent, s.mapping.EntitySet, plan.invoiceID)
+			if _, err := s.writer.CreateRecordContext(ctx, rows.EntitySet, row); err != nil {
+				return atStage(stageRows, fmt.Errorf("failed to create row %s of invoice ID %s, document number %s in Dynamics 365: %w", key, plan.invoiceID, documentNumber, err))
+			}
+			plan.rowWrites++
+			continue
+		}
+
+		// Dubbletter av en rad blir kvar i existing och tas bort nedan
+		current := matches[0]
+		existing[key] = matches[1:]
+		if changes := rows.Diff(current, row); len(changes) > 0 {
+			if err := s.writer.UpdateRecordContext(ctx, rows.EntitySet, recordID(current, rows.IDColumn), changes); err != nil {
+				return atStage(stageRows, fmt.Errorf("failed to update row %s of invoice ID %s, document number %s in Dynamics 365: %w", key, plan.invoiceID, documentNumber, err))
+			}
+			plan.rowWrites++
+		}
+	}
+
+	for key, records := range existing {
+		for _, record := range records {
+			if err := s.writer.DeleteRecordContext(ctx, rows.EntitySet, recordID(record, rows.IDColumn)); err != nil {
+				return atStage(stageRows, fmt.Errorf("failed to delete row %s of invoice ID %s, document number %s from Dynamics 365: %w", key, plan.invoiceID, documentNumber, err))
+			}
+			plan.rowWrites++
+		}
+	}
+	return nil
+}
+
+// recordID returnerar ID:t i en post som lästs från Dynamics 365
+func recordID(record dynamics.Record, idColumn string) string {
+	id, _ := record[idColumn].(string)
+	return id
+}
+
+// invoiceKey returnerar den alternativa nyckeln som fakturan i plan skrivs med vid upsert
+func (s *syncer) invoiceKey(plan *invoicePlan) map[string]interface{} {
+	return map[string]interface{}{s.mapping.KeyColumn: s.mapping.Key(plan.record)}
+}
+
+// writeError märker ett fel från att skapa eller uppdatera fakturan i plan
+func writeError(plan *invoicePlan, err error) error {
+	if plan.create || plan.upsert {
+		return atStage(stageCreate, fmt.Errorf("failed to save invoice for customer number %s, document number %s to Dynamics 365: %w", plan.invoice.CustomerNumber, plan.invoice.DocumentNumber, err))
+	}
+	return atStage(stageUpdate, fmt.Errorf("failed to update invoice ID %s, document number %s in Dynamics 365: %w", plan.invoiceID, plan.invoice.DocumentNumber, err))
+}
+
+// finishInvoice sparar en färdigsynkroniserad faktura i lagret
+func (s *syncer) finishInvoice(plan *invoicePlan) {
+	documentNumber := plan.invoice.DocumentNumber
+	s.store.Put(documentNumber, state.Record{InvoiceID: plan.invoiceID, Hash: plan.hash, SyncedAt: time.Now()})
+	s.store.ClearFailure(documentNumber)
+	if plan.created || plan.upsert {
+		s.saveStore()
+	}
+
+	switch {
+	case plan.created:
+		log.Printf("Processed invoice %s for customer %s", documentNumber, plan.invoice.CustomerNumber)
+	case plan.upsert:
+		log.Printf("Updated invoice %s by document number", documentNumber)
+	case plan.repair:
+		log.Printf("Repaired incomplete invoice %s", documentNumber)
+	case len(plan.changes) > 0:
+		log.Printf("Updated invoice %s (%d changed fields)", documentNumber, len(plan.changes))
+	case plan.rowWrites > 0:
+		log.Printf("Updated rows of invoice %s (%d rows written)", documentNumber, plan.rowWrites)
+	default:
+		log.Printf("Invoice %s already up to date in Dynamics 365", documentNumber)
+	}
+	log.Printf("Processed invoice %s in %s", documentNumber, time.Since(plan.started))
+}
+
+// rollbackInvoice tar bort en nyskapad faktura som inte kunde göras klar. Borttagningen görs
+// även vid ett hårt stopp. Misslyckas den markeras fakturan som ofullständig i lagret, så att
+// nästa körning gör klart den istället för att se den som synkroniserad.
+func (s *syncer) rollbackInvoice(ctx context.Context, invoiceID, documentNumber string) {
+	err := s.writer.DeleteRecordContext(context.WithoutCancel(ctx), s.mapping.EntitySet, invoiceID)
+
+	var odataErr *dynamics.ODataError
+	if err != nil && !(errors.As(err, &odataErr) && odataErr.NotFound()) {
+		log.Printf("Failed to roll back invoice ID %s for document number %s, marking it incomplete: %v", invoiceID, documentNumber, err)
+		s.store.Put(documentNumber, state.Record{InvoiceID: invoiceID, SyncedAt: time.Now(), Incomplete: true})
+		s.saveStore()
+		return
+	}
+
+	log.Printf("Rolled back invoice ID %s for document number %s", invoiceID, documentNumber)
+}
+
+// saveStore sparar lagret mitt i körningen, så att nya fakturor och markeringen av
+// ofullständiga fakturor finns kvar även om processen kraschar eller avbryts innan
+// lagret sparas i slutet. Ett fel här loggas bara, lagret sparas igen vid nästa tillfälle.
+func (s *syncer) saveStore() {
+	if !s.saveProgress {
+		return
+	}
+	if err := s.store.Save(); err != nil {
+		log.Printf("Failed to save sync state: %v", err)
+	}
+}
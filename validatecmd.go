@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/joho/godotenv"
+
+	"fortnox_dynamics_integration/pkg/dynamics"
+)
+
+// runValidate hanterar kommandot "validate", som jämför fältmappningen med schemat i
+// Dynamics 365 utan att skriva något. Tabellerna, kolumnernas typer, värden i valfält,
+// kunduppslaget och fakturaradernas koppling till fakturan kontrolleras mot $metadata, och
+// med DYNAMICS_INVOICE_ALTERNATE_KEY=true även att nyckelkolumnen är en alternativ nyckel.
+// Avslutar med status 1 vid avvikelser.
+func runValidate(args []string) {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	fs.Parse(args)
+
+	if err := godotenv.Load(); err != nil {
+		log.Fatalf("Error loading .env file: %v", err)
+	}
+
+	invoiceMapping, err := loadMapping()
+	if err != nil {
+		log.Fatalf("Failed to load field mapping: %v", err)
+	}
+
+	ctx := context.Background()
+	dynamicsClient, err := newDynamicsClient()
+	if err != nil {
+		log.Fatalf("Failed to set up Dynamics client: %v", err)
+	}
+	if err := dynamicsClient.AuthenticateApiContext(ctx); err != nil {
+		log.Fatalf("Failed to authenticate Dynamics client: %v", err)
+	}
+
+	metadata, err := dynamicsClient.FetchMetadataContext(ctx)
+	if err != nil {
+		log.Fatalf("Failed to fetch Dynamics 365 metadata: %v", err)
+	}
+
+	err = invoiceMapping.CheckSchema(metadata, optionSets(ctx, dynamicsClient, metadata, invoiceMapping.EntitySet))
+	if os.Getenv("DYNAMICS_INVOICE_ALTERNATE_KEY") == "true" {
+		err = errors.Join(err, invoiceMapping.CheckAlternateKey(metadata))
+	}
+	if rows := invoiceMapping.Rows; rows != nil {
+		err = errors.Join(err, invoiceMapping.CheckRowsSchema(metadata, optionSets(ctx, dynamicsClient, metadata, rows.EntitySet)))
+	}
+	if accounts := invoiceMapping.Accounts; accounts != nil {
+		err = errors.Join(err, accounts.CheckSchema(metadata, optionSets(ctx, dynamicsClient, metadata, accounts.EntitySet)))
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Field mapping does not match Dynamics 365:\n%v\n", err)
+		os.Exit(1)
+	}
+
+	log.Printf("Field mapping matches Dynamics 365 (%s, %d columns)", invoiceMapping.EntitySet, len(invoiceMapping.Columns))
+}
+
+// optionSets hämtar valfälten för tabellen bakom entitetsmängden. Valfältens värden finns
+// inte i $metadata och hämtas separat. En okänd entitetsmängd rapporteras av CheckSchema.
+func optionSets(ctx context.Context, dynamicsClient *dynamics.D365, metadata *dynamics.Metadata, entitySet string) map[string][]dynamics.Option {
+	entityType := metadata.EntitySet(entitySet)
+	if entityType == nil {
+		return nil
+	}
+
+	options, err := dynamicsClient.FetchOptionSetsContext(ctx, entityType.Name)
+	if err != nil {
+		log.Fatalf("Failed to fetch option sets: %v", err)
+	}
+	return options
+}